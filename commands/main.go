@@ -18,6 +18,7 @@
 package commands
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
@@ -96,6 +97,34 @@ func ExecStdoutArgsDir(dir string, command string, args []string) error {
 	return c.Run()
 }
 
+// ExecStdoutArgsEnv is a convenience function to execute a command on stdout with
+// the given arguments, adding the environment variables (KEY=value) to our own
+func ExecStdoutArgsEnv(env []string, command string, args []string) error {
+	var c *exec.Cmd
+	var err error
+
+	if c, err = execHelper(command, args); err != nil {
+		return err
+	}
+	c.Env = append(os.Environ(), env...)
+	return c.Run()
+}
+
+// ExecOutputArgs is a convenience function to execute a command with the given
+// arguments, returning everything written to stdout
+func ExecOutputArgs(command string, args []string) (string, error) {
+	var c *exec.Cmd
+	var err error
+
+	if c, err = execHelper(command, args); err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	c.Stdout = buf
+	err = c.Run()
+	return buf.String(), err
+}
+
 // ChrootExec will run a given command in the chroot directory
 func ChrootExec(dir, command string) error {
 	cmdArgs := []string{dir, "/bin/sh", "-c", command}
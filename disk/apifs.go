@@ -0,0 +1,191 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	// APIShmSize is the default size limit of the /dev/shm tmpfs in a root
+	APIShmSize = "50%"
+
+	// APIRunSize is the default size limit of the /run tmpfs in a root
+	APIRunSize = "20%"
+)
+
+// An APIFilesystem is one of the kernel API filesystems that must be present
+// within a root before any chroot operations can take place.
+type APIFilesystem struct {
+	Source     string       // Source of the mount, i.e. "proc"
+	Path       string       // Path within a chroot (no / prefix)
+	Filesystem string       // Filesystem type to mount
+	Mode       os.FileMode  // Mode to create a missing mountpoint with
+	Options    MountOptions // Options to mount with
+}
+
+// DefaultAPIFilesystems returns the standard set of API filesystems, in the
+// order that they must be mounted. Callers may adjust the returned set, such
+// as the tmpfs sizes, before passing it to MountAPIFilesystemSet.
+func DefaultAPIFilesystems() []*APIFilesystem {
+	return []*APIFilesystem{
+		{
+			Source:     "proc",
+			Path:       "proc",
+			Filesystem: "proc",
+			Mode:       00555,
+			Options: MountOptions{
+				Flags:       syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV,
+				Propagation: PropagationPrivate,
+			},
+		},
+		{
+			Source:     "sysfs",
+			Path:       "sys",
+			Filesystem: "sysfs",
+			Mode:       00555,
+			Options: MountOptions{
+				Flags:       syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV,
+				Propagation: PropagationPrivate,
+			},
+		},
+		{
+			Source:     "devtmpfs",
+			Path:       "dev",
+			Filesystem: "devtmpfs",
+			Mode:       00755,
+			Options: MountOptions{
+				Flags:       syscall.MS_NOSUID,
+				Data:        "mode=0755",
+				Propagation: PropagationPrivate,
+			},
+		},
+		{
+			Source:     "devpts",
+			Path:       "dev/pts",
+			Filesystem: "devpts",
+			Mode:       00755,
+			Options: MountOptions{
+				Flags:       syscall.MS_NOSUID | syscall.MS_NOEXEC,
+				Data:        "newinstance,ptmxmode=0666,mode=0620,gid=5",
+				Propagation: PropagationPrivate,
+			},
+		},
+		{
+			Source:     "shm",
+			Path:       "dev/shm",
+			Filesystem: "tmpfs",
+			Mode:       01777,
+			Options: MountOptions{
+				Flags:       syscall.MS_NOSUID | syscall.MS_NODEV,
+				Data:        "mode=1777,size=" + APIShmSize,
+				Propagation: PropagationPrivate,
+			},
+		},
+		{
+			Source:     "run",
+			Path:       "run",
+			Filesystem: "tmpfs",
+			Mode:       00755,
+			Options: MountOptions{
+				Flags:       syscall.MS_NOSUID | syscall.MS_NODEV,
+				Data:        "mode=0755,size=" + APIRunSize,
+				Propagation: PropagationPrivate,
+			},
+		},
+	}
+}
+
+// MountAPIFilesystems will mount the standard set of API filesystems (proc,
+// sys, dev, dev/pts, dev/shm and run) into the given root, creating any of
+// the mountpoints that are missing.
+//
+// Each mount is registered with the MountManager, so UnmountAll will take
+// them back down in the correct order, and the root is registered with AddRoot.
+func (m *MountManager) MountAPIFilesystems(root string) error {
+	return m.MountAPIFilesystemSet(root, DefaultAPIFilesystems())
+}
+
+// MountAPIFilesystemSet will mount the given API filesystems into the root,
+// in order. If any of them fail to mount, those already mounted by this call
+// are unmounted again before returning the error. The host root "/" is
+// refused before anything is mounted.
+func (m *MountManager) MountAPIFilesystemSet(root string, filesystems []*APIFilesystem) error {
+	var mounted []string
+
+	// The root must exist for AddRoot to see through any symlinks to "/"
+	if err := os.MkdirAll(root, 00755); err != nil {
+		return err
+	}
+	if err := m.AddRoot(root); err != nil {
+		return err
+	}
+
+	for _, fs := range filesystems {
+		fpath := filepath.Join(root, fs.Path)
+		if err := os.MkdirAll(fpath, fs.Mode); err != nil {
+			m.rollbackMounts(mounted)
+			return err
+		}
+		opts := fs.Options
+		if err := m.MountWithOptions(fs.Source, fpath, fs.Filesystem, &opts); err != nil {
+			m.rollbackMounts(mounted)
+			return err
+		}
+		mounted = append(mounted, fpath)
+	}
+	return nil
+}
+
+// UnmountAPIFilesystems will unmount the standard API filesystems from the
+// given root, in the reverse order to which they were mounted. Paths that
+// are unknown to the MountManager are skipped.
+func (m *MountManager) UnmountAPIFilesystems(root string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var paths []string
+	for _, fs := range DefaultAPIFilesystems() {
+		fpath, err := filepath.Abs(filepath.Join(root, fs.Path))
+		if err != nil {
+			return err
+		}
+		if _, ok := m.mounts[fpath]; ok {
+			paths = append(paths, fpath)
+		}
+	}
+	return m.unmountPaths(paths)
+}
+
+// rollbackMounts will take down the mounts made so far by a failed call
+func (m *MountManager) rollbackMounts(paths []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unmountPaths(paths)
+}
+
+// unmountPaths will unmount each of the paths in reverse order, returning all
+// of the errors encountered. The caller must hold the lock.
+func (m *MountManager) unmountPaths(paths []string) error {
+	var errs UmountErrors
+	for i := len(paths) - 1; i >= 0; i-- {
+		errs.add(m.unmount(paths[i]))
+	}
+	return errs.errorOrNil()
+}
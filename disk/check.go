@@ -0,0 +1,141 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"github.com/solus-project/libosdev/commands"
+	"os/exec"
+	"syscall"
+)
+
+// CheckMode controls whether CheckFS may modify the filesystem
+type CheckMode int
+
+const (
+	// CheckRepair will fix any errors found without prompting
+	CheckRepair CheckMode = iota
+
+	// CheckReadOnly will only report errors, never modifying the filesystem
+	CheckReadOnly
+)
+
+// CheckStatus is the outcome of a filesystem check, in increasing severity
+type CheckStatus int
+
+const (
+	// CheckClean means no errors were found
+	CheckClean CheckStatus = iota
+
+	// CheckCorrected means errors were found and have been fixed
+	CheckCorrected
+
+	// CheckRebootNeeded means errors were fixed, but the system should be
+	// rebooted if the filesystem is mounted. For an image this is the same
+	// as CheckCorrected.
+	CheckRebootNeeded
+
+	// CheckUncorrected means errors remain on the filesystem
+	CheckUncorrected
+
+	// CheckOperationalError means the checker itself failed, or was used
+	// incorrectly, so the state of the filesystem is unknown
+	CheckOperationalError
+)
+
+// String returns a human readable description of the status
+func (c CheckStatus) String() string {
+	switch c {
+	case CheckClean:
+		return "clean"
+	case CheckCorrected:
+		return "errors corrected"
+	case CheckRebootNeeded:
+		return "errors corrected, reboot needed"
+	case CheckUncorrected:
+		return "errors left uncorrected"
+	default:
+		return "operational error"
+	}
+}
+
+// fsck(8) exit status bits, shared by e2fsck and fsck.f2fs
+const (
+	fsckCorrected   = 1
+	fsckReboot      = 2
+	fsckUncorrected = 4
+	fsckOperational = 8
+	fsckUsage       = 16
+	fsckCancelled   = 32
+	fsckLibrary     = 128
+)
+
+// A CheckResult is the structured result of a filesystem check
+type CheckResult struct {
+	Status   CheckStatus // Overall outcome of the check
+	ExitCode int         // Raw exit code of the checker
+}
+
+// OK determines whether the filesystem is now free of errors
+func (c *CheckResult) OK() bool {
+	return c.Status <= CheckRebootNeeded
+}
+
+// decodeFsckStatus interprets the fsck(8) exit code bitmask
+func decodeFsckStatus(code int) CheckStatus {
+	switch {
+	case code&(fsckOperational|fsckUsage|fsckCancelled|fsckLibrary) != 0:
+		return CheckOperationalError
+	case code&fsckUncorrected != 0:
+		return CheckUncorrected
+	case code&fsckReboot != 0:
+		return CheckRebootNeeded
+	case code&fsckCorrected != 0:
+		return CheckCorrected
+	default:
+		return CheckClean
+	}
+}
+
+// exitCode returns the exit code of a command that ran to completion. false
+// is returned if the command couldn't be run at all.
+func exitCode(err error) (int, bool) {
+	if err == nil {
+		return 0, true
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return -1, false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !status.Exited() {
+		return -1, false
+	}
+	return status.ExitStatus(), true
+}
+
+// runCheck will run the checker, interpreting the exit code with decode
+func runCheck(decode func(code int) CheckStatus, command string, args []string) (*CheckResult, error) {
+	err := commands.ExecStdoutArgs(command, args)
+	code, ok := exitCode(err)
+	if !ok {
+		return nil, err
+	}
+	return &CheckResult{
+		Status:   decode(code),
+		ExitCode: code,
+	}, nil
+}
@@ -0,0 +1,406 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// ficlone is FICLONE from linux/fs.h, sharing all extents of one file with
+// another on filesystems supporting reflinks.
+const ficlone = 0x40049409
+
+// atSymlinkNoFollow is AT_SYMLINK_NOFOLLOW from linux/fcntl.h
+const atSymlinkNoFollow = 0x100
+
+// CopyOptions control how much of a file's metadata is preserved by
+// CopyFileWithOptions and CopyTree. Permissions, symlinks, device nodes,
+// nanosecond timestamps and holes in sparse files are always preserved.
+type CopyOptions struct {
+	NoOwnership bool // Don't preserve the owner and group
+	NoXattrs    bool // Don't preserve xattrs, which includes ACLs and file capabilities
+	NoHardlinks bool // Copy hardlinked files separately, rather than linking them again
+
+	// Reflink shares the data with the source file where the filesystem
+	// supports it (i.e. btrfs or xfs), falling back to copy_file_range which
+	// lets the kernel copy the data without passing it through userspace.
+	Reflink bool
+
+	// PunchHoles leaves holes in the copy wherever the source has whole
+	// blocks of zeroes, in addition to the holes the source already has.
+	// Every block must be read to find them, so reflinks are not used.
+	PunchHoles bool
+}
+
+// fileID uniquely identifies an inode, to find hardlinks
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// copier holds the state of a single copy operation
+type copier struct {
+	options *CopyOptions
+	links   map[fileID]string // Copied inodes with more than one link
+}
+
+func newCopier(options *CopyOptions) *copier {
+	if options == nil {
+		options = &CopyOptions{}
+	}
+	return &copier{
+		options: options,
+		links:   make(map[fileID]string),
+	}
+}
+
+// llistxattr returns the names of all xattrs on the path, without following
+// symlinks.
+func llistxattr(path string) ([]string, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		// Find the size first, then fetch, retrying if it grew in between
+		sz, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(p)), 0, 0)
+		if errno != 0 {
+			return nil, errno
+		}
+		if sz == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, sz)
+		sz, _, errno = syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+		if errno == syscall.ERANGE {
+			continue
+		}
+		if errno != 0 {
+			return nil, errno
+		}
+		var ret []string
+		for _, name := range strings.Split(string(buf[:sz]), "\x00") {
+			if name != "" {
+				ret = append(ret, name)
+			}
+		}
+		return ret, nil
+	}
+}
+
+// lgetxattr returns the value of the xattr, without following symlinks
+func lgetxattr(path, name string) ([]byte, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		sz, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)), 0, 0, 0, 0)
+		if errno != 0 {
+			return nil, errno
+		}
+		buf := make([]byte, sz)
+		if sz == 0 {
+			return buf, nil
+		}
+		sz, _, errno = syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0, 0)
+		if errno == syscall.ERANGE {
+			continue
+		}
+		if errno != 0 {
+			return nil, errno
+		}
+		return buf[:sz], nil
+	}
+}
+
+// lsetxattr sets the value of the xattr, without following symlinks
+func lsetxattr(path, name string, value []byte) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	var v unsafe.Pointer
+	if len(value) > 0 {
+		v = unsafe.Pointer(&value[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)), uintptr(v), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// lutimesNano sets the access and modification times of the path, without
+// following symlinks.
+func lutimesNano(path string, atime, mtime syscall.Timespec) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	times := [2]syscall.Timespec{atime, mtime}
+	dirfd := -100 // AT_FDCWD
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&times[0])), atSymlinkNoFollow, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// canSkipXattr determines whether failing to set the xattr can be ignored.
+// ACLs, file capabilities and trusted xattrs, such as the overlayfs opaque
+// and redirect markers, would leave a broken or wide open copy without them,
+// so they never can. Otherwise the destination not supporting the xattr is
+// fine, as is being refused a user xattr, i.e. on a symlink or device node.
+func canSkipXattr(name string, err error) bool {
+	if strings.HasPrefix(name, "system.posix_acl_") || strings.HasPrefix(name, "trusted.") || name == "security.capability" {
+		return false
+	}
+	return err == syscall.ENOTSUP || (err == syscall.EPERM && strings.HasPrefix(name, "user."))
+}
+
+// copyXattrs will copy every xattr from source to dest. security.capability
+// is included, so this must happen after chown, which clears it.
+//
+// Much like cp -a, xattrs that the destination can't hold are skipped, as
+// decided by canSkipXattr.
+func copyXattrs(source, dest string) error {
+	names, err := llistxattr(source)
+	if err != nil {
+		// Source filesystem has no xattr support, so there is nothing to copy
+		if err == syscall.ENOTSUP {
+			return nil
+		}
+		return err
+	}
+	for _, name := range names {
+		value, err := lgetxattr(source, name)
+		if err != nil {
+			return fmt.Errorf("Failed to read xattr %v of %v: %v", name, source, err)
+		}
+		if err = lsetxattr(dest, name, value); err != nil {
+			if canSkipXattr(name, err) {
+				continue
+			}
+			return fmt.Errorf("Failed to set xattr %v on %v: %v", name, dest, err)
+		}
+	}
+	return nil
+}
+
+// copyMetadata applies the ownership, permissions, xattrs and timestamps of
+// the source to dest, in that order so that nothing undoes a previous step.
+func (c *copier) copyMetadata(source, dest string, st *syscall.Stat_t) error {
+	isLink := st.Mode&syscall.S_IFMT == syscall.S_IFLNK
+	if !c.options.NoOwnership {
+		if err := os.Lchown(dest, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	// Symlink permissions are meaningless, and chmod would follow the link
+	if !isLink {
+		if err := syscall.Chmod(dest, st.Mode&07777); err != nil {
+			return &os.PathError{Op: "chmod", Path: dest, Err: err}
+		}
+	}
+	if !c.options.NoXattrs {
+		if err := copyXattrs(source, dest); err != nil {
+			return err
+		}
+	}
+	if err := lutimesNano(dest, st.Atim, st.Mtim); err != nil {
+		return &os.PathError{Op: "utimensat", Path: dest, Err: err}
+	}
+	return nil
+}
+
+// copyData will copy the contents of src into dst, preserving any holes
+func (c *copier) copyData(src, dst *os.File) error {
+	if c.options.Reflink && !c.options.PunchHoles {
+		if _, err := ioctl(dst.Fd(), ficlone, src.Fd()); err == nil {
+			return nil
+		}
+	}
+	return c.copySparse(src, dst)
+}
+
+// copyRegular will copy the contents of the regular file into a new file
+func (c *copier) copyRegular(source, dest string) error {
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 00600)
+	if err != nil {
+		return err
+	}
+	if err = c.copyData(src, dst); err != nil {
+		dst.Close()
+		return fmt.Errorf("Failed to copy %v to %v: %v", source, dest, err)
+	}
+	return dst.Close()
+}
+
+// removeExisting will remove dest so that it can be replaced, refusing to
+// replace a directory with a file.
+func removeExisting(dest string) error {
+	st, err := os.Lstat(dest)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if st.IsDir() {
+		return fmt.Errorf("Cannot replace directory %v with a file", dest)
+	}
+	return os.Remove(dest)
+}
+
+// copyFile will copy anything other than a directory, replacing whatever
+// may already exist at dest.
+func (c *copier) copyFile(source, dest string, st *syscall.Stat_t) error {
+	if err := removeExisting(dest); err != nil {
+		return err
+	}
+
+	// Recreate the hardlink if we've already copied the inode
+	id := fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+	trackLink := !c.options.NoHardlinks && st.Nlink > 1 && st.Mode&syscall.S_IFMT != syscall.S_IFDIR
+	if trackLink {
+		if target, ok := c.links[id]; ok {
+			return os.Link(target, dest)
+		}
+	}
+
+	var err error
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		err = c.copyRegular(source, dest)
+	case syscall.S_IFLNK:
+		var target string
+		if target, err = os.Readlink(source); err == nil {
+			err = os.Symlink(target, dest)
+		}
+	case syscall.S_IFCHR, syscall.S_IFBLK, syscall.S_IFIFO, syscall.S_IFSOCK:
+		if err = syscall.Mknod(dest, st.Mode, int(st.Rdev)); err != nil {
+			err = &os.PathError{Op: "mknod", Path: dest, Err: err}
+		}
+	default:
+		err = fmt.Errorf("Cannot copy %v, unsupported file type", source)
+	}
+	if err != nil {
+		return err
+	}
+	if err = c.copyMetadata(source, dest, st); err != nil {
+		return err
+	}
+	if trackLink {
+		c.links[id] = dest
+	}
+	return nil
+}
+
+// copyTree will recursively copy the directory source into dest
+func (c *copier) copyTree(source, dest string, st *syscall.Stat_t) error {
+	if dst, err := os.Lstat(dest); err == nil {
+		if !dst.IsDir() {
+			return fmt.Errorf("Cannot replace file %v with a directory", dest)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if err = os.Mkdir(dest, 00700); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		src := filepath.Join(source, name)
+		dst := filepath.Join(dest, name)
+		var cst syscall.Stat_t
+		if err := syscall.Lstat(src, &cst); err != nil {
+			return &os.PathError{Op: "lstat", Path: src, Err: err}
+		}
+		if cst.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			err = c.copyTree(src, dst, &cst)
+		} else {
+			err = c.copyFile(src, dst, &cst)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Only now that the children are written can the timestamps be kept
+	return c.copyMetadata(source, dest, st)
+}
+
+// CopyFile will copy the file and all of its metadata to the new target,
+// replacing anything already there. Symlinks are copied as symlinks.
+func CopyFile(source, dest string) error {
+	return CopyFileWithOptions(source, dest, nil)
+}
+
+// CopyFileWithOptions will copy the file to the new target, replacing
+// anything already there, preserving the metadata requested by options.
+// options may be nil to preserve everything.
+func CopyFileWithOptions(source, dest string, options *CopyOptions) error {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(source, &st); err != nil {
+		return &os.PathError{Op: "lstat", Path: source, Err: err}
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		return fmt.Errorf("Cannot copy directory %v as a file, use CopyTree", source)
+	}
+	return newCopier(options).copyFile(source, dest, &st)
+}
+
+// CopyTree will recursively copy the directory source to dest, preserving
+// the metadata requested by options, and recreating hardlinks within the
+// tree. options may be nil to preserve everything. If dest already exists it
+// must be a directory, and the tree is merged into it.
+func CopyTree(source, dest string, options *CopyOptions) error {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(source, &st); err != nil {
+		return &os.PathError{Op: "lstat", Path: source, Err: err}
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return fmt.Errorf("Cannot copy %v as a tree, it is not a directory", source)
+	}
+	return newCopier(options).copyTree(source, dest, &st)
+}
@@ -18,70 +18,121 @@ package disk
 
 import (
 	"fmt"
-	"github.com/solus-project/libosdev/commands"
 	"os"
 	"path/filepath"
 	"syscall"
 )
 
-// CreateSparseFile will create a new sparse file with the given filename and
-// size in nMegabytes/
+// ImageFileOptions control how CreateImageFile creates the file
+type ImageFileOptions struct {
+	Preallocate    bool // Allocate every block up front, rather than a sparse file
+	NoOverwrite    bool // Fail if the file already exists, rather than replacing it
+	CheckFreeSpace bool // Fail early if the target filesystem can't hold the full size
+}
+
+// checkFreeSpace will ensure the filesystem holding filename has room for
+// size bytes, counting the space freed by replacing any existing file.
+func checkFreeSpace(filename string, size Size) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(filepath.Dir(filename), &st); err != nil {
+		return err
+	}
+	free := Size(st.Bavail) * Size(st.Bsize)
+	if usage, err := GetFileUsage(filename); err == nil {
+		free += usage.Allocated
+	}
+	if free < size {
+		return fmt.Errorf("Not enough free space for %v (%v) in %v: %v available", filename, size, filepath.Dir(filename), free)
+	}
+	return nil
+}
+
+// CreateImageFile will create a new file of exactly size bytes with the given
+// filename, to be used as a disk image. By default this is a sparse file,
+// replacing any existing file. options may be nil to use the defaults.
 //
-// This is highly dependent on the underlying filesystem at the directory
-// where the file is to be created, making use of the syscall ftruncate.
-func CreateSparseFile(filename string, nMegabytes int) error {
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 00644)
+// Sparse files depend on the underlying filesystem at the directory where the
+// file is to be created, making use of the syscall ftruncate.
+func CreateImageFile(filename string, size Size, options *ImageFileOptions) error {
+	if options == nil {
+		options = &ImageFileOptions{}
+	}
+	if options.CheckFreeSpace {
+		if err := checkFreeSpace(filename, size); err != nil {
+			return err
+		}
+	}
+	flags := os.O_CREATE | os.O_WRONLY
+	if options.NoOverwrite {
+		flags |= os.O_EXCL
+	} else {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(filename, flags, 00644)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	// NOTE: New megabytes, not old megabytes (1000, not 1024)
-	sz := int64(nMegabytes * 1000 * 1000)
-	if err = syscall.Ftruncate(int(f.Fd()), sz); err != nil {
+	if err = f.Truncate(int64(size)); err != nil {
 		return err
 	}
+	if !options.Preallocate || size == 0 {
+		return nil
+	}
+	err = syscall.Fallocate(int(f.Fd()), 0, 0, int64(size))
+	// Filesystems without fallocate support, such as some network and FUSE
+	// filesystems, have every block allocated by writing it out instead
+	if err == syscall.EOPNOTSUPP {
+		err = writeZeroes(f, size)
+	}
+	if err != nil {
+		// Don't leave a partially allocated image behind
+		os.Remove(filename)
+		return fmt.Errorf("Failed to preallocate %v: %v", filename, err)
+	}
 	return nil
 }
 
+// writeZeroes will write size bytes of zeroes to the start of the file
+func writeZeroes(f *os.File, size Size) error {
+	buf := make([]byte, MiB)
+	for off := Size(0); off < size; off += Size(len(buf)) {
+		if size-off < Size(len(buf)) {
+			buf = buf[:size-off]
+		}
+		if _, err := f.WriteAt(buf, int64(off)); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// CreateSparseFile will create a new sparse file with the given filename and
+// size in nMegabytes, replacing any existing file.
+//
+// NOTE: New megabytes, not old megabytes (1000, not 1024). Use CreateImageFile
+// for any other size.
+func CreateSparseFile(filename string, nMegabytes int) error {
+	if nMegabytes < 0 {
+		return fmt.Errorf("Invalid size: %d megabytes", nMegabytes)
+	}
+	return CreateImageFile(filename, Size(nMegabytes)*MB, nil)
+}
+
 // GetSquashfsArgs returns the compression arg set for a given compression type
 func GetSquashfsArgs(compressionType CompressionType) ([]string, error) {
 	switch compressionType {
-	case CompressionGzip:
-		return []string{"-comp", "gzip"}, nil
-	case CompressionXZ:
-		return []string{"-comp", "xz"}, nil
+	case CompressionGzip, CompressionXZ, CompressionLZ4, CompressionLZO, CompressionZstd:
+		return []string{"-comp", string(compressionType)}, nil
 	default:
 		return nil, fmt.Errorf("Unknown compression type: %v", compressionType)
 	}
 }
 
 // CreateSquashfs will create a new squashfs filesystem image at the given outputFile path,
-// containing the tree found at path, using compressionType (gzip or xz).
+// containing the tree found at path, using compressionType.
 func CreateSquashfs(path, outputFile string, compressionType CompressionType) error {
-	command := []string{
-		path,
-		outputFile,
-	}
-	dirName := ""
-	if fp, err := filepath.Abs(path); err == nil {
-		dirName = filepath.Dir(fp)
-	} else {
-		return err
-	}
-
-	// May have to set -keep-as-directory
-	if st, err := os.Stat(path); err == nil {
-		if st.Mode().IsDir() {
-			command = append(command, "-keep-as-directory")
-		}
-	} else {
-		return err
-	}
-	// TODO: Add -processors nCPU (4)
-	if execArgs, err := GetSquashfsArgs(compressionType); err == nil {
-		command = append(command, execArgs...)
-	} else {
-		return err
-	}
-	return commands.ExecStdoutArgsDir(dirName, "mksquashfs", command)
+	return CreateSquashfsWithOptions(path, outputFile, &SquashfsOptions{
+		Compression: compressionType,
+	})
 }
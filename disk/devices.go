@@ -18,16 +18,35 @@ package disk
 
 import (
 	"fmt"
-	"github.com/solus-project/libosdev/commands"
+	"os"
 	"path/filepath"
+	"syscall"
+)
+
+// DeviceNodeType is the type of a device node, character or block
+type DeviceNodeType int
+
+const (
+	// DeviceNodeChar is a character device
+	DeviceNodeChar DeviceNodeType = iota
+
+	// DeviceNodeBlock is a block device
+	DeviceNodeBlock
 )
 
 // DeviceNode represents a /dev/ node to be created in chroots
 type DeviceNode struct {
-	Mode  string // Mode to create the device node in
-	Major uint32 // Major ID
-	Minor uint32 // Minor ID
-	Path  string // Path within a chroot (no / prefix)
+	Type  DeviceNodeType // Character or block device
+	Mode  os.FileMode    // Permissions to create the device node with
+	Major uint32         // Major ID
+	Minor uint32         // Minor ID
+	Path  string         // Path within a chroot (no / prefix)
+}
+
+// DeviceSymlink represents a /dev/ symlink to be created in chroots
+type DeviceSymlink struct {
+	Path   string // Path within a chroot (no / prefix)
+	Target string // Where the link points to
 }
 
 var (
@@ -36,17 +55,151 @@ var (
 
 	// DevNodeURandom is /dev/urandom
 	DevNodeURandom *DeviceNode
+
+	// DevNodeNull is /dev/null
+	DevNodeNull *DeviceNode
+
+	// DevNodeZero is /dev/zero
+	DevNodeZero *DeviceNode
+
+	// DevNodeFull is /dev/full
+	DevNodeFull *DeviceNode
+
+	// DevNodeTTY is /dev/tty
+	DevNodeTTY *DeviceNode
+
+	// DevNodeConsole is /dev/console
+	DevNodeConsole *DeviceNode
+
+	// DevNodePtmx is /dev/ptmx
+	DevNodePtmx *DeviceNode
+
+	// DevNodes is the minimal set of nodes needed in a static /dev
+	DevNodes []*DeviceNode
+
+	// DevSymlinks are the standard /dev/fd symlinks into /proc
+	DevSymlinks []*DeviceSymlink
 )
 
 func init() {
-	DevNodeURandom = &DeviceNode{Mode: "00666", Major: 1, Minor: 9, Path: "dev/urandom"}
-	DevNodeRandom = &DeviceNode{Mode: "00666", Major: 1, Minor: 8, Path: "dev/random"}
+	DevNodeURandom = &DeviceNode{Mode: 00666, Major: 1, Minor: 9, Path: "dev/urandom"}
+	DevNodeRandom = &DeviceNode{Mode: 00666, Major: 1, Minor: 8, Path: "dev/random"}
+	DevNodeNull = &DeviceNode{Mode: 00666, Major: 1, Minor: 3, Path: "dev/null"}
+	DevNodeZero = &DeviceNode{Mode: 00666, Major: 1, Minor: 5, Path: "dev/zero"}
+	DevNodeFull = &DeviceNode{Mode: 00666, Major: 1, Minor: 7, Path: "dev/full"}
+	DevNodeTTY = &DeviceNode{Mode: 00666, Major: 5, Minor: 0, Path: "dev/tty"}
+	DevNodeConsole = &DeviceNode{Mode: 00600, Major: 5, Minor: 1, Path: "dev/console"}
+	DevNodePtmx = &DeviceNode{Mode: 00666, Major: 5, Minor: 2, Path: "dev/ptmx"}
+
+	DevNodes = []*DeviceNode{
+		DevNodeNull,
+		DevNodeZero,
+		DevNodeFull,
+		DevNodeRandom,
+		DevNodeURandom,
+		DevNodeTTY,
+		DevNodeConsole,
+		DevNodePtmx,
+	}
+	DevSymlinks = []*DeviceSymlink{
+		{Path: "dev/fd", Target: "/proc/self/fd"},
+		{Path: "dev/stdin", Target: "/proc/self/fd/0"},
+		{Path: "dev/stdout", Target: "/proc/self/fd/1"},
+		{Path: "dev/stderr", Target: "/proc/self/fd/2"},
+	}
+}
+
+// mkdev encodes the major and minor numbers as the kernel expects them
+func mkdev(major, minor uint32) uint64 {
+	dev := uint64(minor & 0xff)
+	dev |= uint64(major&0xfff) << 8
+	dev |= uint64(minor&^0xff) << 12
+	dev |= uint64(major&^0xfff) << 32
+	return dev
+}
+
+// devMajor returns the major number of the encoded device
+func devMajor(dev uint64) uint32 {
+	return uint32((dev>>8)&0xfff) | uint32((dev>>32)&^0xfff)
+}
+
+// devMinor returns the minor number of the encoded device
+func devMinor(dev uint64) uint32 {
+	return uint32(dev&0xff) | uint32((dev>>12)&^0xff)
 }
 
-// CreateDeviceNode will create the essential nodes in a chroot path
+// typeBits returns the S_IF* bits for the node type
+func (d *DeviceNode) typeBits() (uint32, error) {
+	switch d.Type {
+	case DeviceNodeChar:
+		return syscall.S_IFCHR, nil
+	case DeviceNodeBlock:
+		return syscall.S_IFBLK, nil
+	default:
+		return 0, fmt.Errorf("Unknown device node type: %d", d.Type)
+	}
+}
+
+// CreateDeviceNode will create the device node in a chroot path. Nothing is
+// done if the node already exists with the same type and major/minor numbers,
+// other than fixing its permissions.
 func CreateDeviceNode(root string, node *DeviceNode) error {
 	fpath := filepath.Join(root, node.Path)
-	cmd := []string{"-m", node.Mode, fpath, "c", fmt.Sprintf("%d", node.Major), fmt.Sprintf("%d", node.Minor)}
+	typ, err := node.typeBits()
+	if err != nil {
+		return err
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(fpath, &st); err == nil {
+		rdev := uint64(st.Rdev)
+		if st.Mode&syscall.S_IFMT != typ || devMajor(rdev) != node.Major || devMinor(rdev) != node.Minor {
+			return fmt.Errorf("Cannot create device node %v (%d:%d), a different file already exists", fpath, node.Major, node.Minor)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if err := syscall.Mknod(fpath, typ|uint32(node.Mode.Perm()), int(mkdev(node.Major, node.Minor))); err != nil {
+		return fmt.Errorf("Failed to create device node %v: %v", fpath, err)
+	}
+	// mknod is subject to the umask
+	return os.Chmod(fpath, node.Mode.Perm())
+}
+
+// CreateDeviceSymlink will create the symlink in a chroot path. Nothing is
+// done if an identical symlink already exists.
+func CreateDeviceSymlink(root string, link *DeviceSymlink) error {
+	fpath := filepath.Join(root, link.Path)
+	if target, err := os.Readlink(fpath); err == nil {
+		if target != link.Target {
+			return fmt.Errorf("Cannot create symlink %v, it already points to %v", fpath, target)
+		}
+		return nil
+	}
+	return os.Symlink(link.Target, fpath)
+}
 
-	return commands.ExecStdoutArgs("mknod", cmd)
+// PopulateDev will create a minimal static /dev within root, containing
+// DevNodes, DevSymlinks and the pts and shm directories, for chroots that
+// do not have devtmpfs mounted. It is safe to call more than once.
+func PopulateDev(root string) error {
+	dirs := []string{"dev", "dev/pts", "dev/shm"}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, dir), 00755); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(filepath.Join(root, "dev/shm"), os.ModeSticky|00777); err != nil {
+		return err
+	}
+	for _, node := range DevNodes {
+		if err := CreateDeviceNode(root, node); err != nil {
+			return err
+		}
+	}
+	for _, link := range DevSymlinks {
+		if err := CreateDeviceSymlink(root, link); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,229 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"fmt"
+	"github.com/solus-project/libosdev/commands"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErofsOptions control how CreateErofs builds the image
+type ErofsOptions struct {
+	Compression CompressionType // lz4, lz4hc, lzma or zstd, uncompressed if unset
+
+	// CompressionLevel is 1-12 for lz4hc, 0-9 for lzma or 1-22 for zstd.
+	// Any level switches lz4 to lz4hc. Zero uses the mkfs.erofs default.
+	CompressionLevel int
+
+	ClusterSize Size     // Maximum physical cluster size, a multiple of 4KiB
+	Dedupe      bool     // Deduplicate identical compressed data
+	Fragments   bool     // Pack file tails and small files together
+	Excludes    []string // Regular expressions of paths to leave out
+	AllRoot     bool     // Make every file owned by root
+
+	// UUID is the filesystem UUID, random unless Reproducible
+	UUID string
+
+	// Reproducible sets every timestamp, including the build time, to
+	// SOURCE_DATE_EPOCH (or the epoch itself if unset). Unless one is given,
+	// the UUID is derived from the name of the output file, so that distinct
+	// images don't share a UUID while rebuilds elsewhere still match.
+	Reproducible bool
+}
+
+// compressionArgs returns the -z argument for the compression and its level
+func (e *ErofsOptions) compressionArgs() ([]string, error) {
+	comp := e.Compression
+	if comp == "" {
+		if e.CompressionLevel != 0 {
+			return nil, fmt.Errorf("Compression level set without a compression type")
+		}
+		return nil, nil
+	}
+	if comp == CompressionLZ4 && e.CompressionLevel != 0 {
+		comp = CompressionLZ4HC
+	}
+
+	min, max := 0, 0
+	switch comp {
+	case CompressionLZ4:
+		return []string{"-z", string(comp)}, nil
+	case CompressionLZ4HC:
+		min, max = 1, 12
+	case CompressionLZMA:
+		min, max = 0, 9
+	case CompressionZstd:
+		min, max = 1, 22
+	default:
+		return nil, fmt.Errorf("Unknown EROFS compression type: %v", comp)
+	}
+	if e.CompressionLevel == 0 {
+		return []string{"-z", string(comp)}, nil
+	}
+	if e.CompressionLevel < min || e.CompressionLevel > max {
+		return nil, fmt.Errorf("Invalid %v compression level: %d", comp, e.CompressionLevel)
+	}
+	return []string{"-z", fmt.Sprintf("%v,%d", comp, e.CompressionLevel)}, nil
+}
+
+// args returns the mkfs.erofs arguments for the options, where name
+// identifies the image being built
+func (e *ErofsOptions) args(name string) ([]string, error) {
+	args, err := e.compressionArgs()
+	if err != nil {
+		return nil, err
+	}
+	if e.ClusterSize != 0 {
+		if e.ClusterSize%(4*KiB) != 0 {
+			return nil, fmt.Errorf("Invalid EROFS cluster size: %d", e.ClusterSize)
+		}
+		args = append(args, fmt.Sprintf("-C%d", e.ClusterSize))
+	}
+	var extended []string
+	if e.Dedupe {
+		extended = append(extended, "dedupe")
+	}
+	if e.Fragments {
+		extended = append(extended, "fragments")
+	}
+	if len(extended) > 0 {
+		args = append(args, "-E", strings.Join(extended, ","))
+	}
+	for _, exclude := range e.Excludes {
+		args = append(args, "--exclude-regex="+exclude)
+	}
+	if e.AllRoot {
+		args = append(args, "--all-root")
+	}
+	uuid := e.UUID
+	if e.Reproducible {
+		epoch, err := sourceDateEpoch()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, fmt.Sprintf("-T%d", epoch), "--ignore-mtime")
+		if uuid == "" {
+			g := deriveGUID(GUID{}, "erofs:"+name, 0)
+			uuid = strings.ToLower(g.String())
+		}
+	}
+	if uuid != "" {
+		args = append(args, "-U", uuid)
+	}
+	return args, nil
+}
+
+// CreateErofs will create a new EROFS image at the given outputFile path,
+// containing the tree found at path. options may be nil for an uncompressed
+// image.
+func CreateErofs(path, outputFile string, options *ErofsOptions) error {
+	if options == nil {
+		options = &ErofsOptions{}
+	}
+	source, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	st, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if !st.Mode().IsDir() {
+		return fmt.Errorf("EROFS images can only be created from a directory: %v", path)
+	}
+	args, err := options.args(filepath.Base(outputFile))
+	if err != nil {
+		return err
+	}
+	args = append(args, outputFile, source)
+	return commands.ExecStdoutArgs("mkfs.erofs", args)
+}
+
+// ReadOnlyImageFormat is the format of a compressed, read-only image such as
+// the root filesystem of a LiveOS.
+type ReadOnlyImageFormat string
+
+const (
+	// ReadOnlySquashfs is a squashfs image, created by mksquashfs
+	ReadOnlySquashfs ReadOnlyImageFormat = "squashfs"
+
+	// ReadOnlyErofs is an EROFS image, created by mkfs.erofs
+	ReadOnlyErofs ReadOnlyImageFormat = "erofs"
+)
+
+// ReadOnlyImageOptions are the options common to every ReadOnlyImageFormat,
+// allowing the format to be switched with a single setting. Use
+// CreateSquashfsWithOptions or CreateErofs directly for finer control.
+type ReadOnlyImageOptions struct {
+	Format           ReadOnlyImageFormat // squashfs if unset
+	Compression      CompressionType     // Compression, the format's default if unset
+	CompressionLevel int                 // Compression level, the format's default if unset
+	AllRoot          bool                // Make every file owned by root
+	Reproducible     bool                // Use SOURCE_DATE_EPOCH and fixed ordering
+}
+
+// CreateReadOnlyImage will create a read-only image of the tree at path in the
+// chosen format.
+func CreateReadOnlyImage(path, outputFile string, options *ReadOnlyImageOptions) error {
+	if options == nil {
+		options = &ReadOnlyImageOptions{}
+	}
+	switch options.Format {
+	case "", ReadOnlySquashfs:
+		return CreateSquashfsWithOptions(path, outputFile, &SquashfsOptions{
+			Compression:      options.Compression,
+			CompressionLevel: options.CompressionLevel,
+			AllRoot:          options.AllRoot,
+			Reproducible:     options.Reproducible,
+		})
+	case ReadOnlyErofs:
+		return CreateErofs(path, outputFile, &ErofsOptions{
+			Compression:      options.Compression,
+			CompressionLevel: options.CompressionLevel,
+			AllRoot:          options.AllRoot,
+			Reproducible:     options.Reproducible,
+		})
+	default:
+		return fmt.Errorf("Unknown read-only image format: %v", options.Format)
+	}
+}
+
+// ProbeReadOnlyImage will determine the format of the read-only image
+func ProbeReadOnlyImage(filename string) (ReadOnlyImageFormat, error) {
+	magics := []struct {
+		format ReadOnlyImageFormat
+		offset int64
+		magic  []byte
+	}{
+		{ReadOnlySquashfs, 0, []byte("hsqs")},
+		// EROFS_SUPER_MAGIC_V1, 0xE0F5E1E2
+		{ReadOnlyErofs, 1024, []byte{0xE2, 0xE1, 0xF5, 0xE0}},
+	}
+	for _, m := range magics {
+		found, err := hasMagic(filename, m.offset, m.magic)
+		if err != nil {
+			return "", err
+		}
+		if found {
+			return m.format, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown read-only image format: %v", filename)
+}
@@ -19,64 +19,289 @@ package disk
 import (
 	"fmt"
 	"github.com/solus-project/libosdev/commands"
+	"strings"
 )
 
 // FilesystemFormatFunc is the prototype for functions that format filesystems
 // to ensure we can use dedicated functions that can handle filesystem paths
-// correctly (i.e. spaces)
-type FilesystemFormatFunc func(filename string) error
+// correctly (i.e. spaces). options is never nil.
+type FilesystemFormatFunc func(filename string, options *FormatOptions) error
 
 // A FilesystemCheckFunc is a function prototype for performing filesystem
-// checks, i.e. a rootfs.img after unmounting
-type FilesystemCheckFunc func(filename string) error
+// checks, i.e. a rootfs.img after unmounting. An error is only returned if
+// the checker couldn't be run at all.
+type FilesystemCheckFunc func(filename string, mode CheckMode) (*CheckResult, error)
 
-var filesystemCommands map[string]FilesystemFormatFunc
-var checkCommands map[string]FilesystemCheckFunc
+// runFormat will run the mkfs tool in the environment for the options
+func runFormat(options *FormatOptions, command string, args []string) error {
+	env, err := options.env()
+	if err != nil {
+		return err
+	}
+	return commands.ExecStdoutArgsEnv(env, command, args)
+}
 
-func formatExt4(filename string) error {
+func formatExt4(filename string, options *FormatOptions) error {
+	if err := options.check("ext4", formatOptLabel|formatOptUUID|formatOptFeatures|formatOptInodeSize|formatOptReserved|formatOptReproducible); err != nil {
+		return err
+	}
+	args := []string{"-t", "ext4", "-F"}
+	if options.Label != "" {
+		args = append(args, "-L", options.Label)
+	}
+	if options.UUID != "" {
+		args = append(args, "-U", options.UUID)
+	}
+	if len(options.Features) > 0 {
+		args = append(args, "-O", strings.Join(options.Features, ","))
+	}
+	if options.InodeSize != 0 {
+		args = append(args, "-I", fmt.Sprintf("%d", options.InodeSize))
+	}
+	if options.ReservedBlocksPercent != nil {
+		args = append(args, "-m", fmt.Sprintf("%g", *options.ReservedBlocksPercent))
+	}
+	if options.Reproducible {
+		// The directory hash seed is otherwise random
+		args = append(args, "-E", "hash_seed="+options.UUID)
+	}
 	// Format it
-	if err := commands.ExecStdoutArgs("mkfs", []string{"-t", "ext4", "-F", filename}); err != nil {
+	if err := runFormat(options, "mkfs", append(args, filename)); err != nil {
 		return err
 	}
 	// Set the mount count so it doesn't get fsck'd during live boot
-	return commands.ExecStdoutArgs("tune2fs", []string{"-c0", "-i0", filename})
+	return runFormat(options, "tune2fs", []string{"-c0", "-i0", filename})
+}
+
+func checkExt4(filename string, mode CheckMode) (*CheckResult, error) {
+	// Always force a full check, as the clean flag is set after mkfs
+	args := []string{"-f", "-y", filename}
+	if mode == CheckReadOnly {
+		args = []string{"-f", "-n", filename}
+	}
+	return runCheck(decodeFsckStatus, "e2fsck", args)
+}
+
+func formatBtrfs(filename string, options *FormatOptions) error {
+	if err := options.check("btrfs", formatOptLabel|formatOptUUID|formatOptFeatures); err != nil {
+		return err
+	}
+	// btrfs has no periodic checks to disable
+	args := []string{"-f"}
+	if options.Label != "" {
+		args = append(args, "-L", options.Label)
+	}
+	if options.UUID != "" {
+		args = append(args, "-U", options.UUID)
+	}
+	if len(options.Features) > 0 {
+		args = append(args, "-O", strings.Join(options.Features, ","))
+	}
+	return runFormat(options, "mkfs.btrfs", append(args, filename))
 }
 
-func checkExt4(filename string) error {
-	// Check it for errors
-	if err := commands.ExecStdoutArgs("e2fsck", []string{"-y", filename}); err != nil {
+// decodeSimpleStatus is for checkers that only exit non-zero when errors
+// have been found.
+func decodeSimpleStatus(code int) CheckStatus {
+	if code == 0 {
+		return CheckClean
+	}
+	return CheckUncorrected
+}
+
+func checkBtrfs(filename string, mode CheckMode) (*CheckResult, error) {
+	// btrfs check --repair is considered dangerous, so we only ever report
+	// problems, regardless of mode
+	return runCheck(decodeSimpleStatus, "btrfs", []string{"check", "--readonly", filename})
+}
+
+func formatXfs(filename string, options *FormatOptions) error {
+	if err := options.check("xfs", formatOptLabel|formatOptUUID|formatOptFeatures|formatOptInodeSize); err != nil {
 		return err
 	}
-	// Force fix any issues now
-	return commands.ExecStdoutArgs("e2fsck", []string{"-y", "-f", filename})
+	// XFS is never checked at boot, so there is nothing to tune
+	args := []string{"-f"}
+	if options.Label != "" {
+		args = append(args, "-L", options.Label)
+	}
+	if options.UUID != "" {
+		args = append(args, "-m", "uuid="+options.UUID)
+	}
+	for _, feature := range options.Features {
+		args = append(args, "-m", feature)
+	}
+	if options.InodeSize != 0 {
+		args = append(args, "-i", fmt.Sprintf("size=%d", options.InodeSize))
+	}
+	return runFormat(options, "mkfs.xfs", append(args, filename))
+}
+
+func checkXfs(filename string, mode CheckMode) (*CheckResult, error) {
+	if mode == CheckReadOnly {
+		// 1 means corruption was found
+		return runCheck(decodeSimpleStatus, "xfs_repair", []string{"-n", filename})
+	}
+	return runCheck(func(code int) CheckStatus {
+		switch code {
+		case 0:
+			// xfs_repair doesn't tell us whether anything was fixed
+			return CheckClean
+		case 2:
+			// The log is dirty and must be replayed by mounting first
+			return CheckUncorrected
+		default:
+			return CheckOperationalError
+		}
+	}, "xfs_repair", []string{filename})
+}
+
+func formatF2fs(filename string, options *FormatOptions) error {
+	if err := options.check("f2fs", formatOptLabel|formatOptUUID|formatOptFeatures|formatOptReproducible); err != nil {
+		return err
+	}
+	args := []string{"-f"}
+	if options.Label != "" {
+		args = append(args, "-l", options.Label)
+	}
+	if options.UUID != "" {
+		args = append(args, "-U", options.UUID)
+	}
+	if len(options.Features) > 0 {
+		args = append(args, "-O", strings.Join(options.Features, ","))
+	}
+	if options.Reproducible {
+		epoch, err := sourceDateEpoch()
+		if err != nil {
+			return err
+		}
+		args = append(args, "-T", fmt.Sprintf("%d", epoch))
+	}
+	return runFormat(options, "mkfs.f2fs", append(args, filename))
+}
+
+func checkF2fs(filename string, mode CheckMode) (*CheckResult, error) {
+	// Force a full check, fixing anything found
+	args := []string{"-f", "-a", filename}
+	if mode == CheckReadOnly {
+		args = []string{"-f", "--dry-run", filename}
+	}
+	return runCheck(decodeFsckStatus, "fsck.f2fs", args)
+}
+
+func formatSwap(filename string, options *FormatOptions) error {
+	if err := options.check("swap", formatOptLabel|formatOptUUID|formatOptReproducible); err != nil {
+		return err
+	}
+	var args []string
+	if options.Label != "" {
+		args = append(args, "-L", options.Label)
+	}
+	if options.UUID != "" {
+		args = append(args, "-U", options.UUID)
+	}
+	return runFormat(options, "mkswap", append(args, filename))
+}
+
+// swapSignature is found in the final bytes of the first page of swap space
+const swapSignature = "SWAPSPACE2"
+
+// checkSwap has no fsck to run, so instead verifies the swap signature is in
+// place. Nothing can be repaired.
+func checkSwap(filename string, mode CheckMode) (*CheckResult, error) {
+	found, err := probeSwap(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return &CheckResult{Status: CheckUncorrected}, nil
+	}
+	return &CheckResult{Status: CheckClean}, nil
 }
 
 func init() {
-	// Initialise the command maps
-	filesystemCommands = make(map[string]FilesystemFormatFunc)
-	checkCommands = make(map[string]FilesystemCheckFunc)
+	// Initialise the registry with the built in filesystems
+	filesystems = make(map[string]*Filesystem)
 
-	filesystemCommands["ext4"] = formatExt4
-	checkCommands["ext4"] = checkExt4
+	builtin := []*Filesystem{
+		{
+			Name:        "ext4",
+			Format:      formatExt4,
+			Check:       checkExt4,
+			Resize:      resizeExt4,
+			MinimumSize: minimumSizeExt4,
+			Probe:       probeExt4,
+			Tools:       []string{"mkfs", "mkfs.ext4", "tune2fs", "e2fsck", "resize2fs"},
+		},
+		{
+			Name:   "vfat",
+			Format: formatVfat,
+			Check:  checkVfat,
+			Probe:  probeVfat,
+			Tools:  []string{"mkfs.fat", "fsck.fat"},
+		},
+		{
+			Name:        "btrfs",
+			Format:      formatBtrfs,
+			Check:       checkBtrfs,
+			Resize:      resizeBtrfs,
+			MinimumSize: minimumSizeBtrfs,
+			Probe:       probeBtrfs,
+			Tools:       []string{"mkfs.btrfs", "btrfs"},
+		},
+		{
+			Name:   "xfs",
+			Format: formatXfs,
+			Check:  checkXfs,
+			Resize: resizeXfs,
+			Probe:  probeXfs,
+			Tools:  []string{"mkfs.xfs", "xfs_repair", "xfs_growfs"},
+		},
+		{
+			Name:   "f2fs",
+			Format: formatF2fs,
+			Check:  checkF2fs,
+			Probe:  probeF2fs,
+			Tools:  []string{"mkfs.f2fs", "fsck.f2fs"},
+		},
+		{
+			Name:   "swap",
+			Format: formatSwap,
+			Check:  checkSwap,
+			Probe:  probeSwap,
+			Tools:  []string{"mkswap"},
+		},
+	}
+	for _, fs := range builtin {
+		RegisterFilesystem(fs)
+	}
 }
 
 // FormatAs will format the given path with the filesystem specified.
+// options may be nil to use the defaults of the mkfs tool.
 // Note: You should only use this with image paths, it's dangerous!
-func FormatAs(filename, filesystem string) error {
-	command, ok := filesystemCommands[filesystem]
-	if !ok {
+func FormatAs(filename, filesystem string, options *FormatOptions) error {
+	fs, err := GetFilesystem(filesystem)
+	if err != nil || fs.Format == nil {
 		return fmt.Errorf("Cannot format with unknown filesystem '%v'", filesystem)
 	}
-	return command(filename)
+	return fs.Format(filename, options.withDefaults(filesystem))
 }
 
 // CheckFS will try to check/fix the filesystems pointed to by filename
-// using the helpers denoted by filesystem.
+// using the helpers denoted by filesystem. The result is returned whenever
+// the checker ran, along with an error if the filesystem still isn't OK.
 // This should only be used for internal image code on loopback devices!
-func CheckFS(filename, filesystem string) error {
-	command, ok := checkCommands[filesystem]
-	if !ok {
-		return fmt.Errorf("Cannot check with unknown filesystem '%v'", filesystem)
+func CheckFS(filename, filesystem string, mode CheckMode) (*CheckResult, error) {
+	fs, err := GetFilesystem(filesystem)
+	if err != nil || fs.Check == nil {
+		return nil, fmt.Errorf("Cannot check with unknown filesystem '%v'", filesystem)
+	}
+	result, err := fs.Check(filename, mode)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to check %v: %v", filename, err)
+	}
+	if !result.OK() {
+		return result, fmt.Errorf("Check of %v filesystem %v failed: %v", filesystem, filename, result.Status)
 	}
-	return command(filename)
+	return result, nil
 }
@@ -0,0 +1,157 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FormatOptions control how FormatAs creates a filesystem. Setting an option
+// that the filesystem doesn't support is an error, rather than being silently
+// ignored.
+type FormatOptions struct {
+	Label    string   // Filesystem label, i.e. for root=LABEL=
+	UUID     string   // Fixed filesystem UUID (or FAT volume ID), random if unset
+	Features []string // Passed to the filesystem's feature option, i.e. "^has_journal" (ext4) or "reflink=1" (xfs)
+
+	InodeSize             int      // Inode size in bytes (ext4, xfs), mkfs default if unset
+	ReservedBlocksPercent *float64 // Percentage of blocks reserved for root (ext4), mkfs default if nil
+
+	// Reproducible fixes every random and time based value in the superblock,
+	// so that the same inputs always produce the same filesystem. Timestamps
+	// are taken from SOURCE_DATE_EPOCH, or the epoch itself if unset, and a
+	// UUID is derived from the filesystem and label if none is given.
+	//
+	// Only ext4, vfat, f2fs and swap (which has no timestamps) support this.
+	// btrfs and xfs record random and time based values that their mkfs tools
+	// provide no way to fix, so it is an error for them.
+	Reproducible bool
+
+	Vfat *VfatOptions // FAT geometry (vfat)
+}
+
+// Bits for the options a formatter supports
+const (
+	formatOptLabel = 1 << iota
+	formatOptUUID
+	formatOptFeatures
+	formatOptInodeSize
+	formatOptReserved
+	formatOptVfat
+	formatOptReproducible
+)
+
+// formatOptionNames is used to report unsupported options
+var formatOptionNames = map[int]string{
+	formatOptLabel:        "Label",
+	formatOptUUID:         "UUID",
+	formatOptFeatures:     "Features",
+	formatOptInodeSize:    "InodeSize",
+	formatOptReserved:     "ReservedBlocksPercent",
+	formatOptVfat:         "Vfat",
+	formatOptReproducible: "Reproducible",
+}
+
+// withDefaults returns a copy of the options with a UUID filled in when
+// reproducible. options may be nil.
+func (o *FormatOptions) withDefaults(filesystem string) *FormatOptions {
+	ret := FormatOptions{}
+	if o != nil {
+		ret = *o
+	}
+	if ret.Reproducible && ret.UUID == "" {
+		ret.UUID = ret.derivedUUID(filesystem)
+	}
+	return &ret
+}
+
+// derivedUUID returns a stable UUID for the filesystem and label
+func (o *FormatOptions) derivedUUID(filesystem string) string {
+	g := deriveGUID(GUID{}, "filesystem/"+filesystem+"/"+o.Label, 0)
+	return strings.ToLower(g.String())
+}
+
+// set returns the bits of every option that has been set
+func (o *FormatOptions) set() int {
+	ret := 0
+	if o.Label != "" {
+		ret |= formatOptLabel
+	}
+	if o.UUID != "" {
+		ret |= formatOptUUID
+	}
+	if len(o.Features) > 0 {
+		ret |= formatOptFeatures
+	}
+	if o.InodeSize != 0 {
+		ret |= formatOptInodeSize
+	}
+	if o.ReservedBlocksPercent != nil {
+		ret |= formatOptReserved
+	}
+	if o.Vfat != nil {
+		ret |= formatOptVfat
+	}
+	if o.Reproducible {
+		ret |= formatOptReproducible
+	}
+	return ret
+}
+
+// check will ensure only supported options have been set
+func (o *FormatOptions) check(filesystem string, supported int) error {
+	unsupported := o.set() &^ supported
+	for bit := 1; unsupported != 0; bit <<= 1 {
+		if unsupported&bit != 0 {
+			return fmt.Errorf("Filesystem '%v' does not support the %v format option", filesystem, formatOptionNames[bit])
+		}
+	}
+	return nil
+}
+
+// sourceDateEpoch returns SOURCE_DATE_EPOCH, or 0 if it isn't set
+func sourceDateEpoch() (int64, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return 0, nil
+	}
+	t, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil || t < 0 {
+		return 0, fmt.Errorf("Invalid SOURCE_DATE_EPOCH: %v", epoch)
+	}
+	return t, nil
+}
+
+// env returns the environment that mkfs tools should run with. Tools that
+// support reproducible builds pick up SOURCE_DATE_EPOCH, while e2fsprogs
+// has its own variable to fake the current time.
+func (o *FormatOptions) env() ([]string, error) {
+	if !o.Reproducible {
+		return nil, nil
+	}
+	epoch, err := sourceDateEpoch()
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		fmt.Sprintf("SOURCE_DATE_EPOCH=%d", epoch),
+		fmt.Sprintf("E2FSPROGS_FAKE_TIME=%d", epoch),
+	}, nil
+}
@@ -0,0 +1,338 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"unicode/utf16"
+)
+
+const (
+	gptSignature     = "EFI PART"
+	gptRevision      = 0x00010000
+	gptHeaderSize    = 92
+	gptEntryCount    = 128
+	gptEntrySize     = 128
+	gptNameLength    = 36
+	gptEntryTableLen = gptEntryCount * gptEntrySize
+
+	// Limits on the entry arrays we're willing to read from other tools
+	gptMaxEntrySize  = 4096
+	gptMaxEntryCount = 1024
+)
+
+// gptHeader is the GPT header found at LBA 1 and the final LBA
+type gptHeader struct {
+	Signature      [8]byte
+	Revision       uint32
+	HeaderSize     uint32
+	HeaderCRC      uint32
+	Reserved       uint32
+	CurrentLBA     uint64
+	BackupLBA      uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGUID       GUID
+	EntriesLBA     uint64
+	EntryCount     uint32
+	EntrySize      uint32
+	EntriesCRC     uint32
+}
+
+// gptEntry is a single entry in the GPT partition entry array
+type gptEntry struct {
+	Type       GUID
+	GUID       GUID
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       [gptNameLength]uint16
+}
+
+// marshal will encode the header with a freshly computed CRC
+func (h *gptHeader) marshal() []byte {
+	h.HeaderCRC = 0
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, h)
+	b := buf.Bytes()
+	h.HeaderCRC = crc32.ChecksumIEEE(b)
+	binary.LittleEndian.PutUint32(b[16:20], h.HeaderCRC)
+	return b
+}
+
+// entrySectors returns the number of sectors used by the entry array
+func entrySectors(sectorSize int) uint64 {
+	return uint64((gptEntryTableLen + sectorSize - 1) / sectorSize)
+}
+
+// encodeGPTName will encode the partition name as UTF-16LE
+func encodeGPTName(name string) ([gptNameLength]uint16, error) {
+	var ret [gptNameLength]uint16
+	enc := utf16.Encode([]rune(name))
+	if len(enc) > gptNameLength {
+		return ret, fmt.Errorf("Partition name is too long: %v", name)
+	}
+	copy(ret[:], enc)
+	return ret, nil
+}
+
+// decodeGPTName will decode a NUL terminated UTF-16LE partition name
+func decodeGPTName(name [gptNameLength]uint16) string {
+	n := 0
+	for n < len(name) && name[n] != 0 {
+		n++
+	}
+	return string(utf16.Decode(name[:n]))
+}
+
+// protectiveMBR returns the protective MBR for a GPT disk of nSectors
+func protectiveMBR(nSectors uint64) []byte {
+	mbr := make([]byte, 512)
+	size := nSectors - 1
+	if size > 0xFFFFFFFF {
+		size = 0xFFFFFFFF
+	}
+	entry := mbr[446:462]
+	copy(entry[1:4], []byte{0x00, 0x02, 0x00})
+	entry[4] = MBRTypeProtective
+	copy(entry[5:8], []byte{0xFF, 0xFF, 0xFF})
+	binary.LittleEndian.PutUint32(entry[8:12], 1)
+	binary.LittleEndian.PutUint32(entry[12:16], uint32(size))
+	mbr[510] = 0x55
+	mbr[511] = 0xAA
+	return mbr
+}
+
+// isProtectiveMBR determines whether the MBR is protecting a GPT
+func isProtectiveMBR(mbr []byte) bool {
+	for i := 0; i < 4; i++ {
+		if mbr[446+i*16+4] == MBRTypeProtective {
+			return true
+		}
+	}
+	return false
+}
+
+// gptBounds returns the first and last usable LBAs for a GPT disk
+func gptBounds(nSectors uint64, sectorSize int) (uint64, uint64, error) {
+	nEntrySectors := entrySectors(sectorSize)
+	// MBR, header, entries at the start and entries, header at the end
+	if nSectors < 3+2*nEntrySectors {
+		return 0, 0, errors.New("Disk is too small for a GPT")
+	}
+	return 2 + nEntrySectors, nSectors - 2 - nEntrySectors, nil
+}
+
+// writeGPT will lay out the partitions, and write the resulting GPT
+func writeGPT(f *os.File, l *PartitionLayout, size uint64) (*PartitionTable, error) {
+	sector := uint64(l.SectorSize)
+	firstUsable, lastUsable, err := gptBounds(size/sector, l.SectorSize)
+	if err != nil {
+		return nil, err
+	}
+	table, err := l.allocate(firstUsable*sector, (lastUsable+1)*sector-1, size)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeGPTTable(f, table); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// writeGPTTable will write a protective MBR, primary and backup GPT for an
+// existing table to the file, sized according to the table's DiskSize.
+func writeGPTTable(f *os.File, table *PartitionTable) error {
+	sector := uint64(table.SectorSize)
+	nSectors := table.DiskSize / sector
+	nEntrySectors := entrySectors(table.SectorSize)
+	firstUsable, lastUsable, err := gptBounds(nSectors, table.SectorSize)
+	if err != nil {
+		return err
+	}
+	lastLBA := nSectors - 1
+
+	entries := make([]byte, nEntrySectors*sector)
+	for _, p := range table.Partitions {
+		if p.Number < 1 || p.Number > gptEntryCount {
+			return fmt.Errorf("Invalid GPT partition number: %d", p.Number)
+		}
+		if p.Start < firstUsable*sector || p.Start+p.Size > (lastUsable+1)*sector {
+			return fmt.Errorf("Partition %d is outside of the usable disk space", p.Number)
+		}
+		name, err := encodeGPTName(p.Name)
+		if err != nil {
+			return err
+		}
+		// Keep the table in step with what will be read back
+		if p.Bootable {
+			p.Attributes |= PartitionAttrLegacyBIOSBootable
+		}
+		entry := &gptEntry{
+			Type:       p.Type,
+			GUID:       p.GUID,
+			FirstLBA:   p.Start / sector,
+			LastLBA:    (p.Start+p.Size)/sector - 1,
+			Attributes: p.Attributes,
+			Name:       name,
+		}
+		buf := &bytes.Buffer{}
+		binary.Write(buf, binary.LittleEndian, entry)
+		// Entries are stored by partition number
+		copy(entries[(p.Number-1)*gptEntrySize:], buf.Bytes())
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries[:gptEntryTableLen])
+
+	primary := &gptHeader{
+		Revision:       gptRevision,
+		HeaderSize:     gptHeaderSize,
+		CurrentLBA:     1,
+		BackupLBA:      lastLBA,
+		FirstUsableLBA: firstUsable,
+		LastUsableLBA:  lastUsable,
+		DiskGUID:       table.DiskGUID,
+		EntriesLBA:     2,
+		EntryCount:     gptEntryCount,
+		EntrySize:      gptEntrySize,
+		EntriesCRC:     entriesCRC,
+	}
+	copy(primary.Signature[:], gptSignature)
+	backup := *primary
+	backup.CurrentLBA = lastLBA
+	backup.BackupLBA = 1
+	backup.EntriesLBA = lastLBA - nEntrySectors
+
+	headerSector := func(h *gptHeader) []byte {
+		b := make([]byte, sector)
+		copy(b, h.marshal())
+		return b
+	}
+
+	// Zero out the first sector entirely before laying down the protective MBR
+	mbr := make([]byte, sector)
+	copy(mbr, protectiveMBR(nSectors))
+
+	writes := []struct {
+		lba  uint64
+		data []byte
+	}{
+		{0, mbr},
+		{1, headerSector(primary)},
+		{2, entries},
+		{backup.EntriesLBA, entries},
+		{lastLBA, headerSector(&backup)},
+	}
+	for _, w := range writes {
+		if _, err := f.WriteAt(w.data, int64(w.lba*sector)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readGPTHeader will read and validate the GPT header and entries at lba
+func readGPTHeader(f *os.File, lba uint64, sector uint64) (*gptHeader, []byte, error) {
+	b := make([]byte, sector)
+	if _, err := f.ReadAt(b, int64(lba*sector)); err != nil {
+		return nil, nil, err
+	}
+	h := &gptHeader{}
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, h); err != nil {
+		return nil, nil, err
+	}
+	if string(h.Signature[:]) != gptSignature {
+		return nil, nil, errors.New("Missing GPT signature")
+	}
+	if h.HeaderSize < gptHeaderSize || uint64(h.HeaderSize) > sector {
+		return nil, nil, errors.New("Invalid GPT header size")
+	}
+	crc := h.HeaderCRC
+	hdr := make([]byte, h.HeaderSize)
+	copy(hdr, b[:h.HeaderSize])
+	binary.LittleEndian.PutUint32(hdr[16:20], 0)
+	if crc32.ChecksumIEEE(hdr) != crc {
+		return nil, nil, errors.New("GPT header checksum mismatch")
+	}
+	// Entries must be 128 * 2^n bytes, and the array is bounded so that a
+	// corrupt header can't overflow or exhaust memory
+	if h.EntrySize < gptEntrySize || h.EntrySize > gptMaxEntrySize || h.EntrySize&(h.EntrySize-1) != 0 || h.EntryCount > gptMaxEntryCount {
+		return nil, nil, errors.New("Invalid GPT entry array")
+	}
+	entries := make([]byte, uint64(h.EntryCount)*uint64(h.EntrySize))
+	if _, err := f.ReadAt(entries, int64(h.EntriesLBA*sector)); err != nil {
+		return nil, nil, err
+	}
+	if crc32.ChecksumIEEE(entries) != h.EntriesCRC {
+		return nil, nil, errors.New("GPT entry array checksum mismatch")
+	}
+	return h, entries, nil
+}
+
+// readGPT will read the GPT, falling back to the backup header should the
+// primary be damaged. Both 512 and 4096 byte logical sectors are detected.
+func readGPT(f *os.File, size uint64) (*PartitionTable, error) {
+	var h *gptHeader
+	var entries []byte
+	var err error
+	var sector uint64
+
+	for _, sector = range []uint64{512, 4096} {
+		if h, entries, err = readGPTHeader(f, 1, sector); err == nil {
+			break
+		}
+		if h, entries, err = readGPTHeader(f, size/sector-1, sector); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read GPT: %v", err)
+	}
+
+	table := &PartitionTable{
+		Type:       PartitionTableGPT,
+		DiskGUID:   h.DiskGUID,
+		SectorSize: int(sector),
+		DiskSize:   size,
+	}
+	for i := 0; i < int(h.EntryCount); i++ {
+		raw := entries[i*int(h.EntrySize) : i*int(h.EntrySize)+gptEntrySize]
+		entry := &gptEntry{}
+		if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, entry); err != nil {
+			return nil, err
+		}
+		if entry.Type.IsZero() {
+			continue
+		}
+		table.Partitions = append(table.Partitions, &Partition{
+			Number:     i + 1,
+			Start:      entry.FirstLBA * sector,
+			Size:       (entry.LastLBA - entry.FirstLBA + 1) * sector,
+			Type:       entry.Type,
+			MBRType:    mbrTypeFor(entry.Type),
+			GUID:       entry.GUID,
+			Name:       decodeGPTName(entry.Name),
+			Attributes: entry.Attributes,
+			Bootable:   entry.Attributes&PartitionAttrLegacyBIOSBootable != 0,
+		})
+	}
+	return table, nil
+}
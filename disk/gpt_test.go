@@ -0,0 +1,279 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testDiskSize = 64 * MiB
+
+// writeTestGPT will write a GPT with a few partitions to a new image file
+func writeTestGPT(t *testing.T) (string, *PartitionTable) {
+	dir, err := ioutil.TempDir("", "libosdev-gpt-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	filename := filepath.Join(dir, "disk.img")
+	if err := CreateImageFile(filename, testDiskSize, nil); err != nil {
+		t.Fatal(err)
+	}
+	table, err := WritePartitionTable(filename, &PartitionLayout{
+		DiskGUID: mustParseGUID("01234567-89AB-CDEF-0123-456789ABCDEF"),
+		Partitions: []*PartitionSpec{
+			{Name: "ESP", Type: PartitionTypeESP, Size: 8 * MiB, Bootable: true},
+			{Name: "swap", Type: PartitionTypeLinuxSwap, Percent: 25},
+			{Name: "root", Type: PartitionTypeLinuxRootAMD64, Attributes: PartitionAttrReadOnly},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to write partition table: %v", err)
+	}
+	return filename, table
+}
+
+func TestGPTRoundTrip(t *testing.T) {
+	filename, written := writeTestGPT(t)
+	read, err := ReadPartitionTable(filename)
+	if err != nil {
+		t.Fatalf("Failed to read partition table: %v", err)
+	}
+	if read.Type != PartitionTableGPT {
+		t.Fatalf("Expected a GPT, got %v", read.Type)
+	}
+	if read.DiskGUID != written.DiskGUID {
+		t.Errorf("Disk GUID mismatch: %v != %v", read.DiskGUID, written.DiskGUID)
+	}
+	if len(read.Partitions) != len(written.Partitions) {
+		t.Fatalf("Expected %d partitions, got %d", len(written.Partitions), len(read.Partitions))
+	}
+	for i, w := range written.Partitions {
+		r := read.Partitions[i]
+		if r.Number != w.Number || r.Start != w.Start || r.Size != w.Size {
+			t.Errorf("Partition %d geometry mismatch: %+v != %+v", w.Number, r, w)
+		}
+		if r.Type != w.Type || r.GUID != w.GUID || r.Name != w.Name {
+			t.Errorf("Partition %d identity mismatch: %+v != %+v", w.Number, r, w)
+		}
+		if r.Attributes != w.Attributes || r.Bootable != w.Bootable {
+			t.Errorf("Partition %d attributes mismatch: %+v != %+v", w.Number, r, w)
+		}
+	}
+	if !read.Partitions[0].Bootable || read.Partitions[0].Attributes&PartitionAttrLegacyBIOSBootable == 0 {
+		t.Errorf("Bootable partition lost its legacy BIOS bootable attribute")
+	}
+	if read.Partitions[1].Bootable {
+		t.Errorf("Partition 2 should not be bootable")
+	}
+}
+
+func TestGPTHeaders(t *testing.T) {
+	filename, _ := writeTestGPT(t)
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	const sector = 512
+	lastLBA := uint64(testDiskSize)/sector - 1
+
+	// readGPTHeader verifies both the header and entry array CRCs
+	primary, primaryEntries, err := readGPTHeader(f, 1, sector)
+	if err != nil {
+		t.Fatalf("Invalid primary GPT: %v", err)
+	}
+	backup, backupEntries, err := readGPTHeader(f, lastLBA, sector)
+	if err != nil {
+		t.Fatalf("Invalid backup GPT: %v", err)
+	}
+	if primary.CurrentLBA != 1 || primary.BackupLBA != lastLBA {
+		t.Errorf("Primary header has wrong LBAs: current %d, backup %d", primary.CurrentLBA, primary.BackupLBA)
+	}
+	if backup.CurrentLBA != lastLBA || backup.BackupLBA != 1 {
+		t.Errorf("Backup header has wrong LBAs: current %d, backup %d", backup.CurrentLBA, backup.BackupLBA)
+	}
+	if backup.EntriesLBA != lastLBA-entrySectors(sector) {
+		t.Errorf("Backup entries at LBA %d, expected %d", backup.EntriesLBA, lastLBA-entrySectors(sector))
+	}
+	if primary.EntriesCRC != backup.EntriesCRC || string(primaryEntries) != string(backupEntries) {
+		t.Errorf("Primary and backup entry arrays differ")
+	}
+
+	mbr := make([]byte, sector)
+	if _, err := f.ReadAt(mbr, 0); err != nil {
+		t.Fatal(err)
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xAA {
+		t.Errorf("Protective MBR is missing its boot signature")
+	}
+	if !isProtectiveMBR(mbr) {
+		t.Errorf("MBR does not protect the GPT")
+	}
+	entry := mbr[446:462]
+	if start := binary.LittleEndian.Uint32(entry[8:12]); start != 1 {
+		t.Errorf("Protective partition starts at LBA %d, expected 1", start)
+	}
+	if size := binary.LittleEndian.Uint32(entry[12:16]); uint64(size) != lastLBA {
+		t.Errorf("Protective partition is %d sectors, expected %d", size, lastLBA)
+	}
+}
+
+func TestGPTBackupFallback(t *testing.T) {
+	filename, written := writeTestGPT(t)
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Trash the primary header
+	if _, err := f.WriteAt(make([]byte, 512), 512); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	read, err := ReadPartitionTable(filename)
+	if err != nil {
+		t.Fatalf("Failed to read the backup GPT: %v", err)
+	}
+	if len(read.Partitions) != len(written.Partitions) {
+		t.Fatalf("Expected %d partitions from the backup, got %d", len(written.Partitions), len(read.Partitions))
+	}
+}
+
+func TestGPTInvalidEntryArray(t *testing.T) {
+	filename, _ := writeTestGPT(t)
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	h, _, err := readGPTHeader(f, 1, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := []struct {
+		count uint32
+		size  uint32
+	}{
+		{1024, 4194304}, // Overflows 32-bit multiplication to zero
+		{1024, 1048576}, // Would allocate 1GiB
+		{128, 192},      // Not a power of two
+		{128, 64},       // Smaller than an entry
+		{4096, 128},     // Too many entries
+	}
+	for _, s := range sizes {
+		h.EntryCount = s.count
+		h.EntrySize = s.size
+		if _, err := f.WriteAt(h.marshal(), 512); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := readGPTHeader(f, 1, 512); err == nil {
+			t.Errorf("Accepted %d entries of %d bytes", s.count, s.size)
+		}
+	}
+}
+
+// writeTestMBR will write an MBR with a few partitions over an existing GPT
+// image, so that the old GPT headers must be wiped
+func writeTestMBR(t *testing.T) (string, *PartitionTable) {
+	filename, _ := writeTestGPT(t)
+	table, err := WritePartitionTable(filename, &PartitionLayout{
+		Table:    PartitionTableMBR,
+		DiskGUID: mustParseGUID("89ABCDEF-0123-4567-89AB-CDEF01234567"),
+		Partitions: []*PartitionSpec{
+			{Type: PartitionTypeESP, Size: 8 * MiB, Bootable: true},
+			{Type: PartitionTypeLinuxSwap, Size: 4 * MiB},
+			{},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to write partition table: %v", err)
+	}
+	return filename, table
+}
+
+func TestMBRRoundTrip(t *testing.T) {
+	filename, written := writeTestMBR(t)
+	read, err := ReadPartitionTable(filename)
+	if err != nil {
+		t.Fatalf("Failed to read partition table: %v", err)
+	}
+	if read.Type != PartitionTableMBR {
+		t.Fatalf("Expected an MBR, got %v", read.Type)
+	}
+	if read.Signature != written.Signature || read.Signature == 0 {
+		t.Errorf("Disk signature mismatch: %08x != %08x", read.Signature, written.Signature)
+	}
+	if len(read.Partitions) != len(written.Partitions) {
+		t.Fatalf("Expected %d partitions, got %d", len(written.Partitions), len(read.Partitions))
+	}
+	for i, w := range written.Partitions {
+		r := read.Partitions[i]
+		if r.Number != w.Number || r.Start != w.Start || r.Size != w.Size {
+			t.Errorf("Partition %d geometry mismatch: %+v != %+v", w.Number, r, w)
+		}
+		if r.MBRType != w.MBRType || r.Bootable != w.Bootable {
+			t.Errorf("Partition %d type mismatch: %+v != %+v", w.Number, r, w)
+		}
+	}
+	types := []byte{MBRTypeESP, MBRTypeLinuxSwap, MBRTypeLinux}
+	for i, p := range read.Partitions {
+		if p.MBRType != types[i] {
+			t.Errorf("Partition %d has type %02x, expected %02x", p.Number, p.MBRType, types[i])
+		}
+	}
+	if !read.Partitions[0].Bootable || read.Partitions[1].Bootable {
+		t.Errorf("Only the first partition should be active")
+	}
+	last := read.Partitions[2]
+	if last.Start+last.Size > uint64(testDiskSize) {
+		t.Errorf("Final partition ends beyond the disk at %d", last.Start+last.Size)
+	}
+}
+
+func TestMBRWipesGPT(t *testing.T) {
+	filename, _ := writeTestMBR(t)
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, _, err := readGPTHeader(f, 1, 512); err == nil {
+		t.Errorf("Primary GPT header survived writing an MBR")
+	}
+	if _, _, err := readGPTHeader(f, uint64(testDiskSize)/512-1, 512); err == nil {
+		t.Errorf("Backup GPT header survived writing an MBR")
+	}
+}
+
+func TestMBRSectorSize(t *testing.T) {
+	filename, _ := writeTestGPT(t)
+	_, err := WritePartitionTable(filename, &PartitionLayout{
+		Table:      PartitionTableMBR,
+		SectorSize: 4096,
+		Partitions: []*PartitionSpec{{}},
+	})
+	if err == nil {
+		t.Errorf("Wrote an MBR with 4096 byte sectors")
+	}
+}
@@ -0,0 +1,115 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// guardSignals are the signals that a MountGuard will intercept
+var guardSignals = []os.Signal{
+	syscall.SIGINT,
+	syscall.SIGTERM,
+	syscall.SIGHUP,
+}
+
+// A MountGuard ensures that a MountManager is torn down when the process is
+// interrupted by a signal or a panic, so that no mounts are left behind.
+//
+// Typical usage from main:
+//
+//	guard := manager.Guard()
+//	defer guard.Release()
+//	defer guard.Recover()
+type MountGuard struct {
+	manager  *MountManager
+	signals  chan os.Signal
+	done     chan struct{}
+	teardown sync.Once
+	release  sync.Once
+}
+
+// Guard will install handlers for SIGINT, SIGTERM and SIGHUP, unless they are
+// currently ignored by the process. Upon receipt of any of them, all processes
+// inside the roots registered with AddRoot are killed, UnmountAll is called,
+// and then the signal is raised again with the default handler in place.
+func (m *MountManager) Guard() *MountGuard {
+	g := &MountGuard{
+		manager: m,
+		signals: make(chan os.Signal, 1),
+		done:    make(chan struct{}),
+	}
+	// Don't resurrect signals that the process was told to ignore
+	for _, sig := range guardSignals {
+		if !signal.Ignored(sig) {
+			signal.Notify(g.signals, sig)
+		}
+	}
+	go g.watch()
+	return g
+}
+
+// watch waits for a signal until the guard is released
+func (g *MountGuard) watch() {
+	select {
+	case sig := <-g.signals:
+		g.Teardown()
+		g.Release()
+		// Let the default handler take the process down
+		if s, ok := sig.(syscall.Signal); ok {
+			syscall.Kill(os.Getpid(), s)
+		}
+	case <-g.done:
+	}
+}
+
+// Teardown will kill all processes in the managed roots and unmount everything
+// known to the MountManager. It only ever runs once per guard.
+func (g *MountGuard) Teardown() {
+	g.teardown.Do(func() {
+		for _, root := range g.manager.getRoots() {
+			if err := KillProcessesInRoot(root); err != nil {
+				fmt.Fprintf(os.Stderr, "Error killing processes: %v\n", err)
+			}
+		}
+		if err := g.manager.UnmountAll(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error umount: %v\n", err)
+		}
+	})
+}
+
+// Recover must be deferred directly by the caller. In the event of a panic
+// the MountManager is torn down before the panic continues on its way.
+func (g *MountGuard) Recover() {
+	if r := recover(); r != nil {
+		g.Teardown()
+		panic(r)
+	}
+}
+
+// Release will stop the guard from intercepting signals, restoring their
+// previous behaviour. Nothing is torn down.
+func (g *MountGuard) Release() {
+	g.release.Do(func() {
+		signal.Stop(g.signals)
+		close(g.done)
+	})
+}
@@ -0,0 +1,305 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// An ImagePartition describes a partition within an ImageSpec, along with
+// how it should be formatted and where it is mounted.
+type ImagePartition struct {
+	PartitionSpec
+
+	Filesystem   string         // Filesystem to format with, or empty to leave it unformatted
+	Label        string         // Filesystem label, also used as the GPT name if Name is unset
+	Format       *FormatOptions // Options passed to FormatAs, may be nil
+	MountPoint   string         // Absolute path within the staging root, or empty to not mount it
+	MountOptions []string       // Options passed to Mount, i.e. "noatime"
+}
+
+// An ImageSpec describes a complete disk image to be built
+type ImageSpec struct {
+	Size       Size               // Total size of the image file
+	Table      PartitionTableType // GPT or MBR, defaults to GPT
+	DiskGUID   GUID               // Fixed disk GUID for reproducibility, random if unset
+	Alignment  Size               // Partition alignment, DefaultPartitionAlignment if unset
+	Partitions []*ImagePartition  // The partitions, in table order
+}
+
+// An Image is a disk image that has been partitioned, formatted and mounted
+// at a staging root by BuildImage.
+type Image struct {
+	Filename string          // The image file
+	Root     string          // Where the image is mounted
+	Table    *PartitionTable // The partition table written to the image
+	Loop     *LoopDevice     // The loop device for the whole image
+
+	manager    *MountManager
+	devices    map[int]string // Partition number to device node
+	partLoops  []*LoopDevice  // Per-partition loop devices, when partition scanning isn't available
+	spec       *ImageSpec
+	mountOrder []*ImagePartition
+	mounted    []string // Mountpoints we created, in mount order
+}
+
+// layout returns the partition layout for the spec
+func (s *ImageSpec) layout() *PartitionLayout {
+	l := &PartitionLayout{
+		Table:     s.Table,
+		DiskGUID:  s.DiskGUID,
+		Alignment: s.Alignment,
+	}
+	for _, p := range s.Partitions {
+		spec := p.PartitionSpec
+		if spec.Name == "" && (s.Table == "" || s.Table == PartitionTableGPT) {
+			spec.Name = p.Label
+		}
+		l.Partitions = append(l.Partitions, &spec)
+	}
+	return l
+}
+
+// mountOrder returns the partitions to be mounted, parents before children
+func (s *ImageSpec) mountOrder() ([]*ImagePartition, error) {
+	byPath := make(map[string]*ImagePartition)
+	var paths []string
+	for _, p := range s.Partitions {
+		if p.MountPoint == "" {
+			continue
+		}
+		if p.Filesystem == "" {
+			return nil, fmt.Errorf("Cannot mount unformatted partition at %v", p.MountPoint)
+		}
+		if !filepath.IsAbs(p.MountPoint) {
+			return nil, fmt.Errorf("Mountpoint must be an absolute path: %v", p.MountPoint)
+		}
+		mpath := filepath.Clean(p.MountPoint)
+		if _, ok := byPath[mpath]; ok {
+			return nil, fmt.Errorf("Duplicate mountpoint in image: %v", mpath)
+		}
+		byPath[mpath] = p
+		paths = append(paths, mpath)
+	}
+	// A parent is always shorter than its children
+	sort.Stable(sort.Reverse(LenSort(paths)))
+
+	var ret []*ImagePartition
+	for _, p := range paths {
+		ret = append(ret, byPath[p])
+	}
+	return ret, nil
+}
+
+// formatOptions returns the options to format the partition with. Where the
+// format is reproducible, the UUID is derived from the disk GUID so that it
+// is unique within the image.
+func (p *ImagePartition) formatOptions(diskGUID GUID, partition int) *FormatOptions {
+	options := &FormatOptions{}
+	if p.Format != nil {
+		*options = *p.Format
+	}
+	if options.Label == "" {
+		options.Label = p.Label
+	}
+	if options.Reproducible && options.UUID == "" {
+		g := deriveGUID(diskGUID, "filesystem", partition)
+		options.UUID = strings.ToLower(g.String())
+	}
+	return options
+}
+
+// BuildImage will create the image file, write the partition table, format
+// each partition and mount them beneath root, parents before children. The
+// returned Image must be closed to unmount everything and detach the loop
+// devices.
+//
+// Any existing file at filename is overwritten.
+func (m *MountManager) BuildImage(filename, root string, spec *ImageSpec) (*Image, error) {
+	if spec.Size == 0 {
+		return nil, errors.New("Image size must be set")
+	}
+	order, err := spec.mountOrder()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := CreateImageFile(filename, spec.Size, nil); err != nil {
+		return nil, err
+	}
+
+	table, err := WritePartitionTable(filename, spec.layout())
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		Filename:   filename,
+		Root:       root,
+		Table:      table,
+		manager:    m,
+		devices:    make(map[int]string),
+		spec:       spec,
+		mountOrder: order,
+	}
+	if err := img.attach(); err != nil {
+		img.Close()
+		return nil, err
+	}
+	if err := img.format(); err != nil {
+		img.Close()
+		return nil, err
+	}
+	if err := img.mount(); err != nil {
+		img.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+// BuildImage will build the image using the global MountManager
+func BuildImage(filename, root string, spec *ImageSpec) (*Image, error) {
+	return GetMountManager().BuildImage(filename, root, spec)
+}
+
+// attach will attach the image to a loop device and find the partition
+// nodes. Where the kernel doesn't provide partition nodes, such as within
+// some containers, each partition is attached to its own loop device.
+func (i *Image) attach() error {
+	l, err := i.manager.AttachLoop(i.Filename, &LoopOptions{PartScan: true})
+	if err != nil {
+		return err
+	}
+	i.Loop = l
+
+	scanned := true
+	for _, p := range i.Table.Partitions {
+		if !waitForDevice(l.PartitionPath(p.Number)) {
+			scanned = false
+			break
+		}
+	}
+	if scanned {
+		for _, p := range i.Table.Partitions {
+			i.devices[p.Number] = l.PartitionPath(p.Number)
+		}
+		return nil
+	}
+
+	for _, p := range i.Table.Partitions {
+		pl, err := i.manager.AttachLoop(i.Filename, &LoopOptions{
+			Offset:    p.Start,
+			SizeLimit: p.Size,
+		})
+		if err != nil {
+			return err
+		}
+		i.partLoops = append(i.partLoops, pl)
+		i.devices[p.Number] = pl.Path
+	}
+	return nil
+}
+
+// waitForDevice will wait briefly for the block device node to appear
+func waitForDevice(path string) bool {
+	for i := 0; i < LoopMaxTries; i++ {
+		if st, err := os.Stat(path); err == nil && st.Mode()&os.ModeDevice != 0 {
+			return true
+		}
+		time.Sleep(LoopRetryTime)
+	}
+	return false
+}
+
+// format will format every partition with a filesystem
+func (i *Image) format() error {
+	for n, p := range i.spec.Partitions {
+		if p.Filesystem == "" {
+			continue
+		}
+		options := p.formatOptions(i.Table.DiskGUID, n+1)
+		if err := FormatAs(i.PartitionPath(n+1), p.Filesystem, options); err != nil {
+			return fmt.Errorf("Failed to format partition %d as %v: %v", n+1, p.Filesystem, err)
+		}
+	}
+	return nil
+}
+
+// mount will mount the partitions beneath the root in nesting order
+func (i *Image) mount() error {
+	if err := os.MkdirAll(i.Root, 00755); err != nil {
+		return err
+	}
+	for _, p := range i.mountOrder {
+		n := i.partitionNumber(p)
+		target := filepath.Join(i.Root, p.MountPoint)
+		if err := os.MkdirAll(target, 00755); err != nil {
+			return err
+		}
+		if err := i.manager.Mount(i.PartitionPath(n), target, p.Filesystem, p.MountOptions...); err != nil {
+			return fmt.Errorf("Failed to mount partition %d at %v: %v", n, target, err)
+		}
+		i.mounted = append(i.mounted, target)
+	}
+	return nil
+}
+
+// partitionNumber returns the table number of the partition in the spec
+func (i *Image) partitionNumber(p *ImagePartition) int {
+	for n, sp := range i.spec.Partitions {
+		if sp == p {
+			return n + 1
+		}
+	}
+	return -1
+}
+
+// PartitionPath returns the block device for the given partition number
+func (i *Image) PartitionPath(partition int) string {
+	return i.devices[partition]
+}
+
+// Close will unmount the partitions of the image from the staging root,
+// children before parents, along with anything since mounted within them,
+// and detach all of its loop devices. The image file itself is kept.
+//
+// Only the mounts created by BuildImage are touched, and the loop devices
+// are detached even if unmounting fails.
+func (i *Image) Close() error {
+	syscall.Sync()
+	var errs UmountErrors
+	for n := len(i.mounted) - 1; n >= 0; n-- {
+		errs.add(i.manager.Unmount(i.mounted[n]))
+	}
+	i.mounted = nil
+	for _, l := range append(i.partLoops, i.Loop) {
+		if l == nil {
+			continue
+		}
+		errs.add(i.manager.DetachLoop(l))
+	}
+	i.partLoops = nil
+	i.Loop = nil
+	return errs.errorOrNil()
+}
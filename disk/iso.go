@@ -0,0 +1,233 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"fmt"
+	"github.com/solus-project/libosdev/commands"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// ISOVolumeIDLength is the maximum length of an ISO9660 volume ID
+	ISOVolumeIDLength = 32
+
+	// ISOMinEFIImageSize is the smallest EFI image that will be generated
+	ISOMinEFIImageSize = 16 * MiB
+)
+
+// ISOOptions control how CreateISO builds a hybrid ISO. Setting BIOSBootImage
+// makes the ISO bootable on BIOS systems, EFIDirectory makes it bootable on
+// UEFI systems, and both may be set for an ISO that boots on either.
+type ISOOptions struct {
+	VolumeID    string // Volume ID, used to find the live media at boot
+	Publisher   string // Optional publisher ID
+	Application string // Optional application ID
+
+	// BIOSBootImage is the El Torito boot image within the tree, i.e.
+	// "isolinux/isolinux.bin", and BIOSBootCatalog is where the boot catalog
+	// is created, defaulting to "boot.cat" alongside the image.
+	BIOSBootImage   string
+	BIOSBootCatalog string
+
+	// HybridMBR is an isohybrid MBR template on the host, such as syslinux's
+	// isohdpfx.bin, allowing the ISO to boot on BIOS systems from a USB stick.
+	HybridMBR string
+
+	// EFIDirectory is a directory on the host, containing EFI/BOOT, which is
+	// turned into a FAT EFI System Partition image embedded within the ISO.
+	// EFIImageSize may be set to override the generated image size.
+	EFIDirectory string
+	EFIImageSize Size
+
+	// Reproducible sets every date within the ISO, and the EFI image, to
+	// SOURCE_DATE_EPOCH (or the epoch itself if unset).
+	Reproducible bool
+}
+
+// treeSize returns the approximate space used by the tree on a filesystem
+// with 4KiB blocks.
+func treeSize(root string) (Size, error) {
+	var total Size
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		total += Size(info.Size()).alignUp(4*KiB) + 4*KiB
+		return nil
+	})
+	return total, err
+}
+
+// createEFIImage will create a FAT image containing the EFI directory
+func createEFIImage(filename string, options *ISOOptions) error {
+	size := options.EFIImageSize
+	if size == 0 {
+		content, err := treeSize(options.EFIDirectory)
+		if err != nil {
+			return err
+		}
+		// Leave room for the FAT itself
+		size = (content + content/4 + 2*MiB).alignUp(MiB)
+		if size < ISOMinEFIImageSize {
+			size = ISOMinEFIImageSize
+		}
+	}
+	if err := CreateImageFile(filename, size, nil); err != nil {
+		return err
+	}
+
+	// FAT32 needs more clusters than a small image can provide
+	fatSize := 16
+	if size >= 512*MiB {
+		fatSize = 32
+	}
+	err := FormatAs(filename, "vfat", &FormatOptions{
+		Label:        "EFIBOOT",
+		Vfat:         &VfatOptions{FatSize: fatSize},
+		Reproducible: options.Reproducible,
+	})
+	if err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(options.EFIDirectory)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("EFI directory is empty: %v", options.EFIDirectory)
+	}
+	// Copy recursively without mounting, preserving modification times
+	args := []string{"-s", "-m", "-i", filename}
+	for _, entry := range entries {
+		args = append(args, filepath.Join(options.EFIDirectory, entry.Name()))
+	}
+	env, err := (&FormatOptions{Reproducible: options.Reproducible}).env()
+	if err != nil {
+		return err
+	}
+	return commands.ExecStdoutArgsEnv(env, "mcopy", append(args, "::/"))
+}
+
+// args returns the xorriso arguments for the options, with efiImage being
+// the path to the generated EFI image, if any.
+func (i *ISOOptions) args(efiImage string) ([]string, error) {
+	if i.VolumeID == "" {
+		return nil, fmt.Errorf("ISO volume ID must be set")
+	}
+	if len(i.VolumeID) > ISOVolumeIDLength {
+		return nil, fmt.Errorf("ISO volume ID is longer than %d characters: %v", ISOVolumeIDLength, i.VolumeID)
+	}
+	args := []string{
+		"-as", "mkisofs",
+		"-iso-level", "3",
+		"-full-iso9660-filenames",
+		"-joliet",
+		"-joliet-long",
+		"-rational-rock",
+		"-volid", i.VolumeID,
+	}
+	if i.Publisher != "" {
+		args = append(args, "-publisher", i.Publisher)
+	}
+	if i.Application != "" {
+		args = append(args, "-appid", i.Application)
+	}
+
+	if i.BIOSBootImage != "" {
+		catalog := i.BIOSBootCatalog
+		if catalog == "" {
+			catalog = filepath.Join(filepath.Dir(i.BIOSBootImage), "boot.cat")
+		}
+		args = append(args,
+			"-eltorito-boot", strings.TrimPrefix(i.BIOSBootImage, "/"),
+			"-eltorito-catalog", strings.TrimPrefix(catalog, "/"),
+			"-no-emul-boot",
+			"-boot-load-size", "4",
+			"-boot-info-table")
+	}
+	if i.HybridMBR != "" {
+		args = append(args, "-isohybrid-mbr", i.HybridMBR)
+	}
+
+	if efiImage != "" {
+		// Append the ESP after the ISO filesystem, visible in the GPT for
+		// USB boot, and point the El Torito EFI entry at it for optical boot
+		args = append(args,
+			"-append_partition", "2", strings.ToLower(PartitionTypeESP.String()), efiImage,
+			"-appended_part_as_gpt")
+		if i.BIOSBootImage != "" {
+			args = append(args, "-eltorito-alt-boot")
+		}
+		args = append(args,
+			"-e", "--interval:appended_partition_2:all::",
+			"-no-emul-boot")
+	}
+
+	if i.Reproducible {
+		epoch, err := sourceDateEpoch()
+		if err != nil {
+			return nil, err
+		}
+		date := time.Unix(epoch, 0).UTC().Format("20060102150405") + "00"
+		args = append(args, "--modification-date="+date)
+	}
+	return args, nil
+}
+
+// CreateISO will create a hybrid ISO at outputFile from the tree at root,
+// using xorriso. The resulting image may be burned to optical media, or
+// written directly to a USB stick.
+func CreateISO(root, outputFile string, options *ISOOptions) error {
+	if options == nil {
+		return fmt.Errorf("ISO options must be set")
+	}
+	if st, err := os.Stat(root); err != nil {
+		return err
+	} else if !st.Mode().IsDir() {
+		return fmt.Errorf("ISO root is not a directory: %v", root)
+	}
+
+	efiImage := ""
+	if options.EFIDirectory != "" {
+		tmp, err := ioutil.TempDir("", "libosdev-iso-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		efiImage = filepath.Join(tmp, "efiboot.img")
+		if err = createEFIImage(efiImage, options); err != nil {
+			return fmt.Errorf("Failed to create EFI image: %v", err)
+		}
+	}
+
+	args, err := options.args(efiImage)
+	if err != nil {
+		return err
+	}
+	env, err := (&FormatOptions{Reproducible: options.Reproducible}).env()
+	if err != nil {
+		return err
+	}
+	args = append(args, "-output", outputFile, root)
+	return commands.ExecStdoutArgsEnv(env, "xorriso", args)
+}
@@ -0,0 +1,243 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MountStateDirectory is the default location for mount journals. It lives
+	// in /run as mounts never survive a reboot, and neither should journals.
+	MountStateDirectory = "/run/libosdev/mounts"
+
+	// journalSuffix is the file suffix used for all mount journals
+	journalSuffix = ".journal"
+)
+
+// A mountJournal is the on-disk record of a MountManager session, allowing
+// the mounts to be cleaned up should the owning process die unexpectedly.
+type mountJournal struct {
+	PID       int           `json:"pid"`        // Owning process
+	StartTime uint64        `json:"start_time"` // Start time of the process, guards against PID reuse
+	Mounts    []*MountEntry `json:"mounts"`     // All mounts known to the session
+	Loops     []*LoopDevice `json:"loops"`      // All loop devices attached by the session
+}
+
+// processStartTime returns the start time of the given process in clock ticks
+// since boot, as found in /proc/$pid/stat
+func processStartTime(pid int) (uint64, error) {
+	b, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+	// comm may contain spaces and parentheses, so skip past the last ')'
+	stat := string(b)
+	idx := strings.LastIndex(stat, ")")
+	if idx < 0 {
+		return 0, fmt.Errorf("Invalid stat for process %v", pid)
+	}
+	// starttime is field 22, and the first field after comm is field 3
+	fields := strings.Fields(stat[idx+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("Invalid stat for process %v", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// isSessionAlive determines whether the process owning a journal still exists
+func (j *mountJournal) isSessionAlive() bool {
+	st, err := processStartTime(j.PID)
+	if err != nil {
+		return false
+	}
+	return st == j.StartTime
+}
+
+// SetStateDirectory will enable journalling of all mounts into the given
+// directory, such that RecoverMounts may clean them up should this process
+// be killed before it can unmount them. Passing an empty string disables
+// journalling and removes any existing journal.
+func (m *MountManager) SetStateDirectory(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.journalPath != "" {
+		os.Remove(m.journalPath)
+		m.journalPath = ""
+	}
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 00755); err != nil {
+		return err
+	}
+	startTime, err := processStartTime(os.Getpid())
+	if err != nil {
+		return err
+	}
+	m.startTime = startTime
+	session := fmt.Sprintf("%d-%d%s", os.Getpid(), time.Now().UnixNano(), journalSuffix)
+	m.journalPath = filepath.Join(dir, session)
+	return m.writeJournal()
+}
+
+// writeJournal will atomically replace the journal with the current state,
+// removing it entirely when there is nothing left to recover.
+func (m *MountManager) writeJournal() error {
+	if m.journalPath == "" {
+		return nil
+	}
+	if len(m.mounts) == 0 && len(m.loops) == 0 {
+		if err := os.Remove(m.journalPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	journal := &mountJournal{
+		PID:       os.Getpid(),
+		StartTime: m.startTime,
+	}
+	for _, me := range m.mounts {
+		journal.Mounts = append(journal.Mounts, me)
+	}
+	for _, l := range m.loops {
+		journal.Loops = append(journal.Loops, l)
+	}
+	b, err := json.MarshalIndent(journal, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmpPath := m.journalPath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 00644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, m.journalPath)
+}
+
+// syncJournal is used where there is no way to report failure to the caller
+func (m *MountManager) syncJournal() {
+	if err := m.writeJournal(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing mount journal: %v\n", err)
+	}
+}
+
+// readJournal will load a mount journal from disk
+func readJournal(path string) (*mountJournal, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	journal := &mountJournal{}
+	if err = json.Unmarshal(b, journal); err != nil {
+		return nil, fmt.Errorf("Invalid mount journal %v: %v", path, err)
+	}
+	return journal, nil
+}
+
+// recoverJournal will unmount everything left behind by a dead session, and
+// then detach its loop devices
+func recoverJournal(journal *mountJournal) error {
+	m := NewMountManager()
+
+	var keys []string
+	for _, me := range journal.Mounts {
+		m.mounts[me.MountPoint] = me
+		keys = append(keys, me.MountPoint)
+	}
+	sort.Sort(LenSort(keys))
+
+	var errs UmountErrors
+	for _, key := range keys {
+		rpath, err := resolveMountPath(key)
+		if err != nil {
+			continue
+		}
+		mounts, err := MountsBeneath(rpath)
+		if err != nil {
+			return err
+		}
+		// Only interested in it if it's actually still mounted
+		if len(mounts) == 0 || mounts[len(mounts)-1].MountPoint != rpath {
+			continue
+		}
+		errs.add(m.UnmountTree(key))
+	}
+
+	// Only detach loop devices still attached to the same file
+	for _, l := range journal.Loops {
+		if l.IsAttached() {
+			errs.add(l.Detach())
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// RecoverMounts will look for journals in the given state directory that were
+// left behind by dead processes, and unmount everything they recorded along
+// with anything mounted beneath, before detaching their loop devices.
+// Journals are removed once recovered.
+//
+// Journals belonging to processes that are still running are left alone, so
+// this is safe to call on startup while other builds are in progress.
+func RecoverMounts(stateDir string) error {
+	journals, err := filepath.Glob(filepath.Join(stateDir, "*"+journalSuffix))
+	if err != nil {
+		return err
+	}
+	var ret error
+	for _, path := range journals {
+		journal, err := readJournal(path)
+		if err != nil {
+			if ret == nil {
+				ret = err
+			}
+			continue
+		}
+		if journal.isSessionAlive() {
+			continue
+		}
+		if err := recoverJournal(journal); err != nil {
+			if ret == nil {
+				ret = err
+			}
+			continue
+		}
+		if err := os.Remove(path); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
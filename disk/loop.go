@@ -0,0 +1,356 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// LoopControlPath is the control device used to find free loop devices
+	LoopControlPath = "/dev/loop-control"
+
+	// LoopMajor is the major ID for all loop block devices
+	LoopMajor = 7
+
+	// LoopMaxTries is the number of times to try attaching or detaching a loop
+	// device while it is busy
+	LoopMaxTries = 5
+
+	// LoopRetryTime is the length of time to wait between loop attempts
+	LoopRetryTime = 200 * time.Millisecond
+)
+
+// ioctls from linux/loop.h
+const (
+	loopSetFd       = 0x4C00
+	loopClrFd       = 0x4C01
+	loopSetStatus64 = 0x4C04
+	loopConfigure   = 0x4C0A
+	loopCtlGetFree  = 0x4C82
+
+	loFlagsReadOnly = 1
+	loFlagsPartScan = 8
+
+	loNameSize = 64
+	loKeySize  = 32
+)
+
+// loopInfo64 is struct loop_info64
+type loopInfo64 struct {
+	Device         uint64
+	Inode          uint64
+	Rdevice        uint64
+	Offset         uint64
+	SizeLimit      uint64
+	Number         uint32
+	EncryptType    uint32
+	EncryptKeySize uint32
+	Flags          uint32
+	FileName       [loNameSize]byte
+	CryptName      [loNameSize]byte
+	EncryptKey     [loKeySize]byte
+	Init           [2]uint64
+}
+
+// loopConfig is struct loop_config, used by LOOP_CONFIGURE
+type loopConfig struct {
+	Fd        uint32
+	BlockSize uint32
+	Info      loopInfo64
+	Reserved  [8]uint64
+}
+
+// LoopOptions control how a file is attached to a loop device
+type LoopOptions struct {
+	ReadOnly  bool   // Attach the device read-only
+	PartScan  bool   // Have the kernel scan for partitions, i.e. /dev/loop0p1
+	Offset    uint64 // Byte offset into the file where the device starts
+	SizeLimit uint64 // Maximum size of the device in bytes, 0 for the whole file
+	BlockSize uint32 // Logical block size, 0 for the kernel default
+}
+
+// A LoopDevice is a file attached to a loop block device
+type LoopDevice struct {
+	Path        string // Device node, i.e. /dev/loop0
+	Number      int    // The loop number
+	BackingFile string // Absolute path to the file backing the device
+}
+
+// ioctl is a convenience wrapper for the ioctl syscall
+func ioctl(fd, req, arg uintptr) (uintptr, error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if errno != 0 {
+		return r, errno
+	}
+	return r, nil
+}
+
+// loopDevicePath returns the device node path for the loop number
+func loopDevicePath(number int) string {
+	return fmt.Sprintf("/dev/loop%d", number)
+}
+
+// ensureLoopNode will wait briefly for devtmpfs to create the node of a newly
+// allocated loop device, creating it ourselves if it never shows up.
+func ensureLoopNode(number int) error {
+	path := loopDevicePath(number)
+	for i := 0; i < LoopMaxTries; i++ {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		time.Sleep(LoopRetryTime)
+	}
+	return syscall.Mknod(path, syscall.S_IFBLK|00660, int(mkdev(LoopMajor, uint32(number))))
+}
+
+// getFreeLoop asks loop-control for the next free loop number
+func getFreeLoop() (int, error) {
+	ctl, err := os.OpenFile(LoopControlPath, os.O_RDWR, 0)
+	if err != nil {
+		return -1, err
+	}
+	defer ctl.Close()
+	n, err := ioctl(ctl.Fd(), loopCtlGetFree, 0)
+	if err != nil {
+		return -1, fmt.Errorf("Failed to find free loop device: %v", err)
+	}
+	return int(n), nil
+}
+
+// configureLoop will attach the backing file to the loop device, using
+// LOOP_CONFIGURE where available, falling back to LOOP_SET_FD and then
+// LOOP_SET_STATUS64 for kernels older than 5.8.
+//
+// Older kernels reject the unknown ioctl with ENOTTY or EINVAL. As EINVAL is
+// also how a bad block size is rejected, and the legacy path can't set one,
+// it only means LOOP_CONFIGURE is missing when no block size was asked for.
+func configureLoop(loop, backing *os.File, number int, options *LoopOptions) error {
+	config := &loopConfig{
+		Fd:        uint32(backing.Fd()),
+		BlockSize: options.BlockSize,
+	}
+	config.Info.Number = uint32(number)
+	config.Info.Offset = options.Offset
+	config.Info.SizeLimit = options.SizeLimit
+	if options.ReadOnly {
+		config.Info.Flags |= loFlagsReadOnly
+	}
+	if options.PartScan {
+		config.Info.Flags |= loFlagsPartScan
+	}
+	copy(config.Info.FileName[:loNameSize-1], backing.Name())
+
+	_, err := ioctl(loop.Fd(), loopConfigure, uintptr(unsafe.Pointer(config)))
+	if err == nil {
+		return nil
+	}
+	if err != syscall.ENOTTY && (err != syscall.EINVAL || options.BlockSize != 0) {
+		return err
+	}
+
+	// Legacy path, which can't set the block size
+	if _, err = ioctl(loop.Fd(), loopSetFd, backing.Fd()); err != nil {
+		return err
+	}
+	if _, err = ioctl(loop.Fd(), loopSetStatus64, uintptr(unsafe.Pointer(&config.Info))); err != nil {
+		ioctl(loop.Fd(), loopClrFd, 0)
+		return err
+	}
+	return nil
+}
+
+// AttachLoopDevice will attach the given file to the next free loop device.
+// options may be nil to attach the whole file read-write.
+func AttachLoopDevice(filename string, options *LoopOptions) (*LoopDevice, error) {
+	if options == nil {
+		options = &LoopOptions{}
+	}
+	fpath, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	mode := os.O_RDWR
+	if options.ReadOnly {
+		mode = os.O_RDONLY
+	}
+	backing, err := os.OpenFile(fpath, mode, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer backing.Close()
+
+	for i := 0; i < LoopMaxTries; i++ {
+		number, err := getFreeLoop()
+		if err != nil {
+			return nil, err
+		}
+		if err = ensureLoopNode(number); err != nil {
+			return nil, err
+		}
+		loop, err := os.OpenFile(loopDevicePath(number), mode, 0)
+		if err != nil {
+			return nil, err
+		}
+		err = configureLoop(loop, backing, number, options)
+		loop.Close()
+		if err == nil {
+			return &LoopDevice{
+				Path:        loopDevicePath(number),
+				Number:      number,
+				BackingFile: fpath,
+			}, nil
+		}
+		// Someone else grabbed the device before we did
+		if err != syscall.EBUSY {
+			return nil, fmt.Errorf("Failed to attach %v to %v: %v", fpath, loopDevicePath(number), err)
+		}
+	}
+	return nil, fmt.Errorf("Failed to attach %v: no free loop device", fpath)
+}
+
+// PartitionPath returns the device node for the given partition number on
+// a loop device that was attached with PartScan.
+func (l *LoopDevice) PartitionPath(partition int) string {
+	return fmt.Sprintf("%sp%d", l.Path, partition)
+}
+
+// backingFile returns the file the kernel reports as backing the device, or
+// an empty string if it isn't attached to anything.
+func (l *LoopDevice) backingFile() string {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/sys/block/loop%d/loop/backing_file", l.Number))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// IsAttached determines whether the device is still attached to its file.
+// The kernel reports the fully resolved path, so both sides are resolved
+// before comparing.
+func (l *LoopDevice) IsAttached() bool {
+	backing := l.backingFile()
+	if backing == "" {
+		return false
+	}
+	if rpath, err := filepath.EvalSymlinks(backing); err == nil {
+		backing = rpath
+	}
+	fpath := l.BackingFile
+	if rpath, err := filepath.EvalSymlinks(fpath); err == nil {
+		fpath = rpath
+	}
+	return backing == fpath
+}
+
+// Detach will release the loop device, retrying while it is still busy
+func (l *LoopDevice) Detach() error {
+	loop, err := os.OpenFile(l.Path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer loop.Close()
+
+	for i := 0; i < LoopMaxTries; i++ {
+		_, err = ioctl(loop.Fd(), loopClrFd, 0)
+		// ENXIO means it was already detached
+		if err == nil || err == syscall.ENXIO {
+			return nil
+		}
+		if err != syscall.EBUSY {
+			break
+		}
+		time.Sleep(LoopRetryTime)
+	}
+	return fmt.Errorf("Failed to detach %v: %v", l.Path, err)
+}
+
+// AttachLoop will attach the file to a loop device, tracking it so that
+// UnmountAll will detach it once everything is unmounted.
+func (m *MountManager) AttachLoop(filename string, options *LoopOptions) (*LoopDevice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.attachLoop(filename, options)
+}
+
+// attachLoop will attach and track the loop device. The caller must hold the
+// lock.
+func (m *MountManager) attachLoop(filename string, options *LoopOptions) (*LoopDevice, error) {
+	l, err := AttachLoopDevice(filename, options)
+	if err != nil {
+		return nil, err
+	}
+	m.loops[l.Path] = l
+	if err := m.writeJournal(); err != nil {
+		delete(m.loops, l.Path)
+		l.Detach()
+		return nil, fmt.Errorf("Failed to write journal for %v: %v", l.Path, err)
+	}
+	return l, nil
+}
+
+// DetachLoop will detach a loop device previously attached by AttachLoop
+func (m *MountManager) DetachLoop(l *LoopDevice) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.loops[l.Path]; !ok {
+		return fmt.Errorf("Attempting to detach unknown loop device to manager: %v", l.Path)
+	}
+	if err := l.Detach(); err != nil {
+		return err
+	}
+	delete(m.loops, l.Path)
+	m.syncJournal()
+	return nil
+}
+
+// releaseLoop will detach the loop device and stop tracking it, leaving it
+// to UnmountAll should it still be busy. The caller must hold the lock.
+func (m *MountManager) releaseLoop(path string) {
+	l, ok := m.loops[path]
+	if !ok {
+		return
+	}
+	if err := l.Detach(); err != nil {
+		return
+	}
+	delete(m.loops, path)
+	m.syncJournal()
+}
+
+// detachLoops will detach every loop device, collecting the errors. The
+// caller must hold the lock.
+func (m *MountManager) detachLoops() error {
+	var errs UmountErrors
+	for key, l := range m.loops {
+		if err := l.Detach(); err != nil {
+			errs.add(err)
+			continue
+		}
+		delete(m.loops, key)
+	}
+	m.syncJournal()
+	return errs.errorOrNil()
+}
@@ -18,11 +18,6 @@
 // functions within libosdev.
 package disk
 
-import (
-	"io"
-	"os"
-)
-
 // CompressionType is the possible compression type to be used with a LiveOS
 // image build
 type CompressionType string
@@ -33,34 +28,19 @@ const (
 
 	// CompressionXZ will compress the squashfs using xz
 	CompressionXZ CompressionType = "xz"
-)
 
-// CopyFile will copy the file and permissions to the new target
-func CopyFile(source, dest string) error {
-	var src *os.File
-	var dst *os.File
-	var err error
-	var st os.FileInfo
+	// CompressionLZ4 will compress the squashfs using lz4, for fast decompression
+	CompressionLZ4 CompressionType = "lz4"
+
+	// CompressionLZO will compress the squashfs using lzo
+	CompressionLZO CompressionType = "lzo"
 
-	// Stat the source first
-	st, err = os.Stat(source)
-	if err != nil {
-		return nil
-	}
-	if src, err = os.Open(source); err != nil {
-		return err
-	}
-	defer src.Close()
-	if dst, err = os.OpenFile(dest, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, st.Mode()); err != nil {
-		return err
-	}
-	// Copy the files
-	if _, err = io.Copy(dst, src); err != nil {
-		dst.Close()
-		return err
-	}
-	dst.Close()
-	// If it fails, meh.
-	os.Chtimes(dest, st.ModTime(), st.ModTime())
-	return nil
-}
+	// CompressionZstd will compress the squashfs using zstd
+	CompressionZstd CompressionType = "zstd"
+
+	// CompressionLZ4HC will compress an EROFS image using high compression lz4
+	CompressionLZ4HC CompressionType = "lz4hc"
+
+	// CompressionLZMA will compress an EROFS image using lzma (microlzma)
+	CompressionLZMA CompressionType = "lzma"
+)
@@ -0,0 +1,127 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	mbrSignatureOffset = 440
+	mbrEntriesOffset   = 446
+	mbrEntrySize       = 16
+	mbrMaxPartitions   = 4
+
+	// Traditional geometry for CHS addressing
+	mbrHeads           = 255
+	mbrSectorsPerTrack = 63
+)
+
+// chsAddress returns the CHS encoding of the LBA, saturating at the maximum
+// address as is the convention for large disks.
+func chsAddress(lba uint64) [3]byte {
+	c := lba / (mbrHeads * mbrSectorsPerTrack)
+	if c > 1023 {
+		return [3]byte{0xFE, 0xFF, 0xFF}
+	}
+	h := (lba / mbrSectorsPerTrack) % mbrHeads
+	s := lba%mbrSectorsPerTrack + 1
+	return [3]byte{byte(h), byte(s) | byte((c>>2)&0xC0), byte(c)}
+}
+
+// writeMBR will write a legacy DOS partition table, and wipe any GPT headers
+// so that the disk isn't mistaken for GPT.
+func writeMBR(f *os.File, l *PartitionLayout, size uint64) (*PartitionTable, error) {
+	if len(l.Partitions) > mbrMaxPartitions {
+		return nil, fmt.Errorf("MBR supports at most %d partitions", mbrMaxPartitions)
+	}
+	sector := uint64(l.SectorSize)
+	nSectors := size / sector
+	if nSectors < 2 {
+		return nil, errors.New("Disk is too small for an MBR")
+	}
+	table, err := l.allocate(sector, nSectors*sector-1, size)
+	if err != nil {
+		return nil, err
+	}
+
+	mbr := make([]byte, sector)
+	binary.LittleEndian.PutUint32(mbr[mbrSignatureOffset:], table.Signature)
+	for i, p := range table.Partitions {
+		start := p.Start / sector
+		length := p.Size / sector
+		if start+length > 0xFFFFFFFF {
+			return nil, fmt.Errorf("Partition %d exceeds the 2TiB limit of MBR", p.Number)
+		}
+		entry := mbr[mbrEntriesOffset+i*mbrEntrySize : mbrEntriesOffset+(i+1)*mbrEntrySize]
+		if p.Bootable {
+			entry[0] = 0x80
+		}
+		first := chsAddress(start)
+		last := chsAddress(start + length - 1)
+		copy(entry[1:4], first[:])
+		entry[4] = p.MBRType
+		copy(entry[5:8], last[:])
+		binary.LittleEndian.PutUint32(entry[8:12], uint32(start))
+		binary.LittleEndian.PutUint32(entry[12:16], uint32(length))
+	}
+	mbr[510] = 0x55
+	mbr[511] = 0xAA
+
+	if _, err := f.WriteAt(mbr, 0); err != nil {
+		return nil, err
+	}
+
+	// Wipe primary and backup GPT headers left over from a previous table
+	blank := make([]byte, sector)
+	if _, err := f.WriteAt(blank, int64(sector)); err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteAt(blank, int64((nSectors-1)*sector)); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// readMBR will parse the primary partitions of a legacy DOS partition table
+func readMBR(mbr []byte, size uint64) (*PartitionTable, error) {
+	table := &PartitionTable{
+		Type:       PartitionTableMBR,
+		Signature:  binary.LittleEndian.Uint32(mbr[mbrSignatureOffset:]),
+		SectorSize: DefaultSectorSize,
+		DiskSize:   size,
+	}
+	for i := 0; i < mbrMaxPartitions; i++ {
+		entry := mbr[mbrEntriesOffset+i*mbrEntrySize : mbrEntriesOffset+(i+1)*mbrEntrySize]
+		if entry[4] == 0 {
+			continue
+		}
+		start := uint64(binary.LittleEndian.Uint32(entry[8:12]))
+		length := uint64(binary.LittleEndian.Uint32(entry[12:16]))
+		table.Partitions = append(table.Partitions, &Partition{
+			Number:   i + 1,
+			Start:    start * DefaultSectorSize,
+			Size:     length * DefaultSectorSize,
+			MBRType:  entry[4],
+			Bootable: entry[0]&0x80 != 0,
+		})
+	}
+	return table, nil
+}
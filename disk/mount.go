@@ -22,7 +22,8 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
-	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -53,41 +54,122 @@ const (
 	UmountRetryTime = 500 * time.Millisecond
 )
 
+// A MountError is returned when the mount syscall itself fails
+type MountError struct {
+	Source     string // What was being mounted
+	MountPoint string // Where it was being mounted
+	Err        error  // The error from the mount syscall
+}
+
+// Error returns a description of the failure
+func (e *MountError) Error() string {
+	return fmt.Sprintf("Failed to mount %v at %v: %v", e.Source, e.MountPoint, e.Err)
+}
+
 // A MountEntry is tracked by the MountManager to enable proper cleanup takes
 // place
 type MountEntry struct {
-	SourcePath string // The source of the mount
-	MountPoint string // The destination mount point
+	SourcePath string       // The source of the mount
+	MountPoint string       // The destination mount point
+	Filesystem string       // The filesystem type, empty for bind mounts
+	Options    MountOptions // The options used to create the mount
+	Loop       string       // Loop device set up for a regular file source, if any
+}
+
+// umountPath will unmount the path with the given flags, treating a path
+// that is no longer mounted as success.
+func umountPath(path string, flags int) error {
+	err := syscall.Unmount(path, flags)
+	if err == syscall.EINVAL || err == syscall.ENOENT {
+		return nil
+	}
+	return err
 }
 
 // Umount will attempt to unmount the given path
 func (m *MountEntry) Umount() error {
-	return commands.ExecStdoutArgs("umount", []string{m.MountPoint})
+	return umountPath(m.MountPoint, 0)
 }
 
 // UmountForce will attempt to forcibly detach the mountpoint
 func (m *MountEntry) UmountForce() error {
-	return commands.ExecStdoutArgs("umount", []string{"-f", m.MountPoint})
+	return umountPath(m.MountPoint, syscall.MNT_FORCE)
 }
 
 // UmountLazy will attempt a lazy detach of the node
 func (m *MountEntry) UmountLazy() error {
-	return commands.ExecStdoutArgs("umount", []string{"-l", m.MountPoint})
+	return umountPath(m.MountPoint, syscall.MNT_DETACH)
 }
 
-// UmountSync will attempt everything possible to umount itself
+// UmountSync will attempt everything possible to umount itself, following
+// the DefaultUmountPolicy.
 func (m *MountEntry) UmountSync() error {
-	for i := 0; i < UmountMaxTries; i++ {
-		if err := m.Umount(); err == nil {
+	return m.UmountWithPolicy(nil)
+}
+
+// UmountWithPolicy will try to cleanly unmount, backing off between attempts
+// and dealing with any processes holding the mount busy as the policy says,
+// before escalating to forced and lazy unmounts. A nil policy is the same as
+// DefaultUmountPolicy.
+//
+// If it has to resort to a forced unmount or lazy detach, or fails entirely,
+// an *UmountError is returned describing what was attempted and which
+// processes held the mount busy, with Unmounted set if the mount did go
+// away. A lazily detached mount is hidden, but remains alive until those
+// processes let go of it.
+func (m *MountEntry) UmountWithPolicy(policy *UmountPolicy) error {
+	p := policy.withDefaults()
+	uerr := &UmountError{MountPoint: m.MountPoint}
+	wait := p.RetryTime
+
+	for uerr.Tries < p.MaxTries {
+		uerr.Tries++
+		if uerr.Err = m.Umount(); uerr.Err == nil {
 			return nil
 		}
-		time.Sleep(UmountRetryTime)
+		// No sense retrying anything other than a busy mount
+		if uerr.Err != syscall.EBUSY {
+			break
+		}
+		uerr.Holders, _ = ProcessesUsingPath(m.MountPoint)
+		if len(uerr.Holders) > 0 && p.Terminate != TerminateNever {
+			timeout := p.TerminateTimeout
+			if p.Terminate == TerminateKill {
+				timeout = 0
+			}
+			TerminateProcesses(uerr.Holders, timeout)
+			uerr.Terminated = appendProcesses(uerr.Terminated, uerr.Holders)
+		}
+		if uerr.Tries < p.MaxTries {
+			time.Sleep(wait)
+			wait = p.nextWait(wait)
+		}
 	}
+
 	// Still didn't manage to umount it
-	if err := m.UmountForce(); err == nil {
-		return nil
+	if !p.DisableForce {
+		uerr.Forced = true
+		if err := m.UmountForce(); err == nil {
+			uerr.Unmounted = true
+			return uerr
+		}
+	}
+	if !p.DisableLazy {
+		uerr.Lazy = true
+		uerr.Detached = m.UmountLazy() == nil
+		uerr.Unmounted = uerr.Detached
 	}
-	return m.UmountLazy()
+	return uerr
+}
+
+// isUmounted determines whether the mount went away, even if UmountSync
+// returned an error because it had to be forced or lazily detached.
+func isUmounted(err error) bool {
+	if err == nil {
+		return true
+	}
+	uerr, ok := err.(*UmountError)
+	return ok && uerr.Unmounted
 }
 
 // A MountManager is used to mount and unmount filesystems, and to track them
@@ -96,41 +178,119 @@ func (m *MountEntry) UmountSync() error {
 // It is relied upon to provide bulletproof unmounting in instances of failure,
 // so that in every event the mountpoints are always taken back down, ensuring
 // no usability issues for the USpin user.
+//
+// Each build should use its own MountManager, constructed with NewMountManager,
+// so that tearing down one build can never affect the mounts of another. All
+// methods are safe for concurrent use.
 type MountManager struct {
+	mu            sync.Mutex
 	mounts        map[string]*MountEntry
-	privateMounts bool // Whether we mount private or not
+	loops         map[string]*LoopDevice // Loop devices to detach after unmounting
+	roots         map[string]bool        // Roots that processes may be chrooted into
+	privateMounts bool                   // Whether we mount private or not
+	umountPolicy  *UmountPolicy          // How to deal with busy mounts
+	journalPath   string                 // Where we journal mounts, if enabled
+	startTime     uint64                 // Our process start time, recorded in the journal
 }
 
 var mountManager *MountManager
 
 func init() {
-	mountManager = &MountManager{}
-	mountManager.mounts = make(map[string]*MountEntry)
-	mountManager.privateMounts = false
+	mountManager = NewMountManager()
 }
 
-// GetMountManager will return the global mount manager
+// NewMountManager will return a new MountManager with no known mounts
+func NewMountManager() *MountManager {
+	return &MountManager{
+		mounts:        make(map[string]*MountEntry),
+		loops:         make(map[string]*LoopDevice),
+		roots:         make(map[string]bool),
+		privateMounts: false,
+	}
+}
+
+// GetMountManager will return the global mount manager, used by default when
+// a more specific MountManager hasn't been set up.
 func GetMountManager() *MountManager {
 	return mountManager
 }
 
-// SetPrivateMounts will instruct MountManager to use --make-private whenever
-// mounting a new device.
+// SetPrivateMounts will instruct MountManager to make every new mount private,
+// unless the MountOptions for that mount request a specific propagation type.
 func (m *MountManager) SetPrivateMounts(b bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.privateMounts = b
 }
 
+// SetUmountPolicy will change how busy mounts are dealt with when unmounting.
+// Passing nil restores the DefaultUmountPolicy.
+func (m *MountManager) SetUmountPolicy(policy *UmountPolicy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.umountPolicy = policy
+}
+
+// AddRoot will register a root filesystem that processes may be chrooted into,
+// so that they can be killed off by a MountGuard before unmounting. The host
+// root "/" is refused.
+func (m *MountManager) AddRoot(root string) error {
+	rpath, err := resolveMountPath(root)
+	if err != nil {
+		return err
+	}
+	if rpath == "/" {
+		return fmt.Errorf("Refusing to register the host root: %v", root)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.roots[rpath] = true
+	return nil
+}
+
+// getRoots returns a copy of the registered roots
+func (m *MountManager) getRoots() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var roots []string
+	for root := range m.roots {
+		roots = append(roots, root)
+	}
+	return roots
+}
+
 // insertMount will store the given mount point in order to permit deletion of it later
-func (m *MountManager) insertMount(sourcepath, destpath string) {
+func (m *MountManager) insertMount(sourcepath, destpath, filesystem string, options *MountOptions) {
 	me := &MountEntry{
 		SourcePath: sourcepath,
 		MountPoint: destpath,
+		Filesystem: filesystem,
+		Options:    *options,
 	}
 	m.mounts[destpath] = me
 }
 
-// Mount will attempt to mount the given sourcepath at the destpath
+// Mount will attempt to mount the given sourcepath at the destpath.
+// The options are mount(8) style strings, see ParseMountOptions.
 func (m *MountManager) Mount(sourcepath, destpath, filesystem string, options ...string) error {
+	opts := ParseMountOptions(options...)
+	// Legacy spelling for bind mounts
+	if filesystem == "--bind" {
+		opts.Bind = true
+		filesystem = ""
+	}
+	return m.MountWithOptions(sourcepath, destpath, filesystem, opts)
+}
+
+// MountWithOptions will attempt to mount the given sourcepath at the destpath,
+// using the flags, data and propagation set in options. options may be nil.
+//
+// As with mount(8), a regular file is first attached to a loop device, which
+// is detached again once the mount is taken down.
+func (m *MountManager) MountWithOptions(sourcepath, destpath, filesystem string, options *MountOptions) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	// Only store the absolute path for the mountpoint
 	dpath, err := filepath.Abs(destpath)
 	if err != nil {
@@ -141,87 +301,333 @@ func (m *MountManager) Mount(sourcepath, destpath, filesystem string, options ..
 		return fmt.Errorf("Path already known to MountManager: %v", dpath)
 	}
 
-	command := []string{
-		sourcepath,
-		destpath,
+	opts := MountOptions{}
+	if options != nil {
+		opts = *options
+	}
+
+	flags := opts.Flags
+	if opts.Bind {
+		// The filesystem type is ignored by the kernel for bind mounts
+		filesystem = ""
+		flags |= syscall.MS_BIND
+		if opts.Recursive {
+			flags |= syscall.MS_REC
+		}
+	}
+
+	source := sourcepath
+	loop := ""
+	if !opts.Bind {
+		if st, serr := os.Stat(sourcepath); serr == nil && st.Mode().IsRegular() {
+			l, lerr := m.attachLoop(sourcepath, &LoopOptions{ReadOnly: flags&syscall.MS_RDONLY != 0})
+			if lerr != nil {
+				return lerr
+			}
+			source, loop = l.Path, l.Path
+			defer func() {
+				if err != nil {
+					m.releaseLoop(loop)
+				}
+			}()
+		}
 	}
 
-	if len(options) > 1 {
-		optString := strings.Join(options, ",")
-		command = append(command, "-o")
-		command = append(command, optString)
+	if err := syscall.Mount(source, dpath, filesystem, flags, opts.Data); err != nil {
+		return &MountError{Source: sourcepath, MountPoint: dpath, Err: err}
 	}
-	// Might be empty if bind-mounting
-	if filesystem != "--bind" {
-		command = append(command, []string{
-			"-t",
-			filesystem,
-		}...)
-	} else {
-		command = append(command, "--bind")
+
+	// Linux ignores the per-mount flags on the initial bind, so they have to
+	// be applied with a remount
+	if opts.Bind && opts.Flags != 0 {
+		remount := syscall.MS_REMOUNT | syscall.MS_BIND | opts.Flags
+		if err := syscall.Mount("", dpath, "", remount, ""); err != nil {
+			syscall.Unmount(dpath, 0)
+			return fmt.Errorf("Failed to apply flags to bind mount %v: %v", dpath, err)
+		}
 	}
 
 	// Set up private mounts if instructed to do so
-	if m.privateMounts {
-		command = append(command, "--make-private")
+	propagation := opts.Propagation
+	if propagation == PropagationDefault && m.privateMounts {
+		propagation = PropagationPrivate
+	}
+	if propagation != PropagationDefault {
+		if err := syscall.Mount("", dpath, "", propagation.flags(), ""); err != nil {
+			syscall.Unmount(dpath, 0)
+			return fmt.Errorf("Failed to set propagation of %v: %v", dpath, err)
+		}
 	}
 
-	if err := commands.ExecStdoutArgs("mount", command); err != nil {
-		return err
+	// A mount that can't be journaled can't be recovered, so don't keep it
+	m.insertMount(sourcepath, dpath, filesystem, &opts)
+	m.mounts[dpath].Loop = loop
+	if err := m.writeJournal(); err != nil {
+		delete(m.mounts, dpath)
+		syscall.Unmount(dpath, 0)
+		return fmt.Errorf("Failed to write journal for %v: %v", dpath, err)
 	}
-	m.insertMount(sourcepath, dpath)
 	return nil
 }
 
+// forgetMount will stop tracking the mount, releasing any loop device that
+// was set up for it. The caller must hold the lock.
+func (m *MountManager) forgetMount(key string) {
+	if me, ok := m.mounts[key]; ok && me.Loop != "" {
+		m.releaseLoop(me.Loop)
+	}
+	delete(m.mounts, key)
+}
+
 // BindMount will attempt to mount the given sourcepath at the destpath with a binding
 func (m *MountManager) BindMount(sourcepath, destpath string, options ...string) error {
-	return m.Mount(sourcepath, destpath, "--bind", options...)
+	opts := ParseMountOptions(options...)
+	opts.Bind = true
+	return m.MountWithOptions(sourcepath, destpath, "", opts)
+}
+
+// BindMountWithOptions will bind mount the sourcepath at the destpath using
+// the given options. Set Recursive in the options to perform an rbind.
+func (m *MountManager) BindMountWithOptions(sourcepath, destpath string, options *MountOptions) error {
+	opts := MountOptions{}
+	if options != nil {
+		opts = *options
+	}
+	opts.Bind = true
+	return m.MountWithOptions(sourcepath, destpath, "", &opts)
 }
 
 // RemountReadonly allows forcing a bindmount to be read-only, because for whatever
 // reason, to this day, Linux _still_ ignores "-o ro" when issuing a bind mount.
+// The other per-mount flags, such as nosuid, are kept.
 func (m *MountManager) RemountReadonly(destpath string) error {
 	dpath, err := filepath.Abs(destpath)
 	if err != nil {
 		return err
 	}
-	command := []string{
-		"-o",
-		"remount,ro",
-		dpath,
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dpath, &st); err != nil {
+		return err
+	}
+	// The ST_* mount flags share their values with the MS_* flags
+	keep := uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME)
+	flags := syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY | keep
+	if err := syscall.Mount("", dpath, "", flags, ""); err != nil {
+		return fmt.Errorf("Failed to remount %v read-only: %v", dpath, err)
+	}
+	return nil
+}
+
+// managedKey will find the key of the managed mount that lives at the given
+// (resolved) path, as reported by mountinfo.
+func (m *MountManager) managedKey(path string) (string, bool) {
+	if _, ok := m.mounts[path]; ok {
+		return path, true
 	}
-	if err := commands.ExecStdoutArgs("mount", command); err != nil {
+	for key := range m.mounts {
+		if rpath, err := resolveMountPath(key); err == nil && rpath == path {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// isManagedBeneath determines whether the path lives beneath any of the
+// mounts known to the MountManager
+func (m *MountManager) isManagedBeneath(path string) bool {
+	for key := range m.mounts {
+		rpath, err := resolveMountPath(key)
+		if err != nil {
+			continue
+		}
+		if isPathBeneath(path, rpath) {
+			return true
+		}
+	}
+	return false
+}
+
+// unmountInfo will unmount a mount discovered via mountinfo, forgetting about
+// it if it is also known to the MountManager.
+func (m *MountManager) unmountInfo(info *MountInfo) error {
+	me := &MountEntry{
+		SourcePath: info.Source,
+		MountPoint: info.MountPoint,
+		Filesystem: info.Filesystem,
+	}
+	policy := m.umountPolicy
+	key, ok := m.managedKey(info.MountPoint)
+	if ok {
+		me = m.mounts[key]
+	} else if !m.isManagedBeneath(info.MountPoint) {
+		// Never force or lazily detach a mount we have no claim to
+		p := policy.withDefaults()
+		p.DisableForce = true
+		p.DisableLazy = true
+		policy = &p
+	}
+	err := me.UmountWithPolicy(policy)
+	if ok && isUmounted(err) {
+		m.forgetMount(key)
+		m.syncJournal()
+	}
+	return err
+}
+
+// unmountSubmounts will take down everything mounted beneath the given path,
+// including anything stacked on top of it, leaving only the lowest mount at
+// the path itself in place.
+func (m *MountManager) unmountSubmounts(path string) error {
+	rpath, err := resolveMountPath(path)
+	if err != nil {
 		return err
 	}
+	mounts, err := MountsBeneath(rpath)
+	if err != nil {
+		return err
+	}
+	// The final entry is the lowest mount on the path itself
+	if len(mounts) > 0 && mounts[len(mounts)-1].MountPoint == rpath {
+		mounts = mounts[:len(mounts)-1]
+	}
+	for _, info := range mounts {
+		if err := m.unmountInfo(info); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Unmount will attempt to unmount the given path
+// Unmount will attempt to unmount the given path, after first unmounting
+// anything that has since been mounted beneath it.
+//
+// Paths that were not mounted by the MountManager may only be unmounted if
+// they live beneath a path that was.
 func (m *MountManager) Unmount(mountpoint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.unmount(mountpoint)
+}
+
+// unmount is the lock-free implementation of Unmount
+func (m *MountManager) unmount(mountpoint string) error {
 	dpath, err := filepath.Abs(mountpoint)
 	if err != nil {
 		return err
 	}
 	me, ok := m.mounts[dpath]
 	if !ok {
-		return fmt.Errorf("Attempting to umount unknown path to manager: %v", dpath)
+		return m.unmountForeign(dpath)
+	}
+	if err := m.unmountSubmounts(dpath); err != nil {
+		return err
+	}
+	err = me.UmountWithPolicy(m.umountPolicy)
+	if isUmounted(err) {
+		m.forgetMount(dpath)
+		m.syncJournal()
 	}
-	err = me.UmountSync()
-	delete(m.mounts, dpath)
 	return err
 }
 
-// UnmountAll will attempt to unmount all registered mountpoints
-func (m *MountManager) UnmountAll() {
+// unmountForeign will unmount a path that we didn't mount ourselves, so long
+// as it lives beneath one of our own mounts.
+func (m *MountManager) unmountForeign(dpath string) error {
+	rpath, err := resolveMountPath(dpath)
+	if err != nil {
+		return err
+	}
+	if !m.isManagedBeneath(rpath) {
+		return fmt.Errorf("Attempting to umount unknown path to manager: %v", dpath)
+	}
+	mounts, err := MountsBeneath(rpath)
+	if err != nil {
+		return err
+	}
+	if len(mounts) == 0 || mounts[len(mounts)-1].MountPoint != rpath {
+		return fmt.Errorf("Attempting to umount path that isn't mounted: %v", dpath)
+	}
+	// Unmount everything beneath, and then the topmost mount on the path
+	for _, info := range mounts {
+		if err := m.unmountInfo(info); err != nil {
+			return err
+		}
+		if info.MountPoint == rpath {
+			break
+		}
+	}
+	return nil
+}
+
+// UnmountTree will recursively unmount everything at or beneath the given path,
+// whether or not it was mounted by the MountManager, deepest mounts first.
+// Every failure is reported in the returned UmountErrors.
+//
+// Only mounts known to the MountManager, and those beneath them, are forced
+// or lazily detached when busy. Anything else is only cleanly unmounted, and
+// the root filesystem itself is refused outright.
+func (m *MountManager) UnmountTree(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rpath, err := resolveMountPath(path)
+	if err != nil {
+		return err
+	}
+	if rpath == "/" {
+		return fmt.Errorf("Refusing to unmount the tree at /: %v", path)
+	}
+	mounts, err := MountsBeneath(rpath)
+	if err != nil {
+		return err
+	}
+	var errs UmountErrors
+	for _, info := range mounts {
+		errs.add(m.unmountInfo(info))
+	}
+
+	// Forget anything we knew of that has already gone away
+	remaining := make(map[string]bool)
+	if mounts, err = MountsBeneath(rpath); err == nil {
+		for _, info := range mounts {
+			remaining[info.MountPoint] = true
+		}
+	}
+	for key := range m.mounts {
+		kpath, err := resolveMountPath(key)
+		if err == nil && isPathBeneath(kpath, rpath) && !remaining[kpath] {
+			m.forgetMount(key)
+		}
+	}
+	m.syncJournal()
+	return errs.errorOrNil()
+}
+
+// UnmountAll will attempt to unmount all registered mountpoints, along with
+// anything else that has since been mounted beneath them. Finally, all loop
+// devices attached through the MountManager are detached.
+//
+// Every mountpoint is attempted, and any failures are returned together as
+// UmountErrors. Mounts that remain mounted are still known to the manager.
+func (m *MountManager) UnmountAll() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	commands.ExecStdoutArgs("sync", nil)
 	var keys []string
 	for key := range m.mounts {
 		keys = append(keys, key)
 	}
 	sort.Sort(LenSort(keys))
+
+	var errs UmountErrors
 	for _, key := range keys {
-		if err := m.Unmount(key); err != nil {
-			fmt.Fprintf(os.Stderr, "Error umount: %v\n", err)
+		// May have been taken down with a parent already
+		if _, ok := m.mounts[key]; !ok {
+			continue
 		}
+		errs.add(m.unmount(key))
 	}
+	errs.add(m.detachLoops())
+	return errs.errorOrNil()
 }
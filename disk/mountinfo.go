@@ -0,0 +1,236 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MountInfoPath is where the kernel exposes the mount table for our namespace
+const MountInfoPath = "/proc/self/mountinfo"
+
+// MountInfo is a single mount as described by /proc/self/mountinfo
+type MountInfo struct {
+	ID           int      // Unique ID of the mount
+	ParentID     int      // ID of the parent mount
+	Major        int      // Major ID of the backing device
+	Minor        int      // Minor ID of the backing device
+	Root         string   // Root of the mount within the filesystem
+	MountPoint   string   // Where the mount lives in our namespace
+	Options      string   // Per-mount options, i.e. "rw,nosuid"
+	Optional     []string // Optional fields, i.e. "shared:1"
+	Filesystem   string   // Filesystem type
+	Source       string   // Filesystem specific source, i.e. "/dev/sda1"
+	SuperOptions string   // Per-superblock options
+}
+
+// unescapeMountInfo will replace the octal escapes (i.e. "\040" for a space)
+// that the kernel uses in mountinfo fields.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// parseMountInfoLine will parse a single line of mountinfo
+func parseMountInfoLine(line string) (*MountInfo, error) {
+	fields := strings.Fields(line)
+
+	// Find the separator between the optional fields and the rest
+	sep := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 || len(fields) < sep+4 {
+		return nil, fmt.Errorf("Invalid mountinfo line: %v", line)
+	}
+
+	info := &MountInfo{
+		Root:         unescapeMountInfo(fields[3]),
+		MountPoint:   unescapeMountInfo(fields[4]),
+		Options:      fields[5],
+		Optional:     fields[6:sep],
+		Filesystem:   fields[sep+1],
+		Source:       unescapeMountInfo(fields[sep+2]),
+		SuperOptions: fields[sep+3],
+	}
+
+	var err error
+	if info.ID, err = strconv.Atoi(fields[0]); err != nil {
+		return nil, fmt.Errorf("Invalid mount ID in mountinfo: %v", fields[0])
+	}
+	if info.ParentID, err = strconv.Atoi(fields[1]); err != nil {
+		return nil, fmt.Errorf("Invalid parent ID in mountinfo: %v", fields[1])
+	}
+	devs := strings.SplitN(fields[2], ":", 2)
+	if len(devs) != 2 {
+		return nil, fmt.Errorf("Invalid device in mountinfo: %v", fields[2])
+	}
+	if info.Major, err = strconv.Atoi(devs[0]); err != nil {
+		return nil, fmt.Errorf("Invalid device in mountinfo: %v", fields[2])
+	}
+	if info.Minor, err = strconv.Atoi(devs[1]); err != nil {
+		return nil, fmt.Errorf("Invalid device in mountinfo: %v", fields[2])
+	}
+	return info, nil
+}
+
+// ParseMountInfo will parse the mountinfo formatted table in r, returning the
+// mounts in the same order as the kernel lists them.
+func ParseMountInfo(r io.Reader) ([]*MountInfo, error) {
+	var mounts []*MountInfo
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		info, err := parseMountInfoLine(line)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, info)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// GetMountInfo will return the current mount table for our mount namespace
+func GetMountInfo() ([]*MountInfo, error) {
+	f, err := os.Open(MountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseMountInfo(f)
+}
+
+// isPathBeneath determines whether path is root itself or lives under it
+func isPathBeneath(path, root string) bool {
+	if root == "/" || path == root {
+		return true
+	}
+	return strings.HasPrefix(path, root+"/")
+}
+
+// resolveMountPath will return the absolute path with symlinks resolved
+// where possible, for comparison with the paths in mountinfo.
+func resolveMountPath(path string) (string, error) {
+	dpath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if rpath, err := filepath.EvalSymlinks(dpath); err == nil {
+		return rpath, nil
+	}
+	return dpath, nil
+}
+
+// unmountOrder sorts mounts so that children always come before their parents,
+// and stacked mounts are taken down from the top.
+type unmountOrder struct {
+	mounts []*MountInfo
+	depth  []int
+	index  []int
+}
+
+func (u *unmountOrder) Len() int {
+	return len(u.mounts)
+}
+
+func (u *unmountOrder) Swap(a, b int) {
+	u.mounts[a], u.mounts[b] = u.mounts[b], u.mounts[a]
+	u.depth[a], u.depth[b] = u.depth[b], u.depth[a]
+	u.index[a], u.index[b] = u.index[b], u.index[a]
+}
+
+func (u *unmountOrder) Less(a, b int) bool {
+	if u.depth[a] != u.depth[b] {
+		return u.depth[a] > u.depth[b]
+	}
+	// Later mounts are on top
+	return u.index[a] > u.index[b]
+}
+
+// sortForUnmount will sort the mounts into a safe order for unmounting
+func sortForUnmount(mounts []*MountInfo) {
+	byID := make(map[int]*MountInfo)
+	for _, info := range mounts {
+		byID[info.ID] = info
+	}
+	order := &unmountOrder{
+		mounts: mounts,
+		depth:  make([]int, len(mounts)),
+		index:  make([]int, len(mounts)),
+	}
+	for i, info := range mounts {
+		depth := 0
+		seen := make(map[int]bool)
+		for p, ok := byID[info.ParentID]; ok && !seen[p.ID]; p, ok = byID[p.ParentID] {
+			seen[p.ID] = true
+			depth++
+		}
+		order.depth[i] = depth
+		order.index[i] = i
+	}
+	sort.Sort(order)
+}
+
+// MountsBeneath will return every mount at or beneath the given path from
+// mountinfo, ordered so that they can be unmounted safely (deepest first).
+func MountsBeneath(path string) ([]*MountInfo, error) {
+	root, err := resolveMountPath(path)
+	if err != nil {
+		return nil, err
+	}
+	all, err := GetMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	var mounts []*MountInfo
+	for _, info := range all {
+		if isPathBeneath(info.MountPoint, root) {
+			mounts = append(mounts, info)
+		}
+	}
+	sortForUnmount(mounts)
+	return mounts, nil
+}
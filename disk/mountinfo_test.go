@@ -0,0 +1,179 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnescapeMountInfo(t *testing.T) {
+	paths := []struct {
+		input string
+		path  string
+	}{
+		{"/mnt/plain", "/mnt/plain"},
+		{"/mnt/with\\040space", "/mnt/with space"},
+		{"/mnt/with\\011tab", "/mnt/with\ttab"},
+		{"/mnt/back\\134slash", "/mnt/back\\slash"},
+		{"/mnt/new\\012line", "/mnt/new\nline"},
+		{"/mnt/\\040\\040two", "/mnt/  two"},
+		{"/mnt/end\\040", "/mnt/end "},
+		{"/mnt/short\\04", "/mnt/short\\04"},
+		{"/mnt/bad\\089", "/mnt/bad\\089"},
+		{"/mnt/range\\777", "/mnt/range\\777"},
+	}
+	for _, p := range paths {
+		if path := unescapeMountInfo(p.input); path != p.path {
+			t.Errorf("Unescaped %q as %q, expected %q", p.input, path, p.path)
+		}
+	}
+}
+
+func TestParseMountInfo(t *testing.T) {
+	table := strings.Join([]string{
+		"22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw",
+		"",
+		"23 22 0:5 / /proc rw,nosuid,nodev,noexec - proc proc rw",
+		"40 22 0:35 /sub\\040dir /mnt/my\\040root rw shared:20 master:3 - tmpfs my\\011src rw,size=1024k",
+		"41 40 7:0 / /mnt/my\\040root/back\\134slash ro unbindable - squashfs /dev/loop0 ro",
+	}, "\n")
+	mounts, err := ParseMountInfo(strings.NewReader(table))
+	if err != nil {
+		t.Fatalf("Failed to parse mountinfo: %v", err)
+	}
+	expected := []*MountInfo{
+		{
+			ID: 22, ParentID: 1, Major: 8, Minor: 1,
+			Root: "/", MountPoint: "/", Options: "rw,relatime",
+			Optional: []string{"shared:1"}, Filesystem: "ext4",
+			Source: "/dev/sda1", SuperOptions: "rw",
+		},
+		{
+			ID: 23, ParentID: 22, Major: 0, Minor: 5,
+			Root: "/", MountPoint: "/proc", Options: "rw,nosuid,nodev,noexec",
+			Optional: []string{}, Filesystem: "proc",
+			Source: "proc", SuperOptions: "rw",
+		},
+		{
+			ID: 40, ParentID: 22, Major: 0, Minor: 35,
+			Root: "/sub dir", MountPoint: "/mnt/my root", Options: "rw",
+			Optional: []string{"shared:20", "master:3"}, Filesystem: "tmpfs",
+			Source: "my\tsrc", SuperOptions: "rw,size=1024k",
+		},
+		{
+			ID: 41, ParentID: 40, Major: 7, Minor: 0,
+			Root: "/", MountPoint: "/mnt/my root/back\\slash", Options: "ro",
+			Optional: []string{"unbindable"}, Filesystem: "squashfs",
+			Source: "/dev/loop0", SuperOptions: "ro",
+		},
+	}
+	if len(mounts) != len(expected) {
+		t.Fatalf("Expected %d mounts, got %d", len(expected), len(mounts))
+	}
+	for i, e := range expected {
+		if !reflect.DeepEqual(mounts[i], e) {
+			t.Errorf("Mount %d parsed as %+v, expected %+v", i, mounts[i], e)
+		}
+	}
+}
+
+func TestParseMountInfoInvalid(t *testing.T) {
+	lines := []string{
+		"22 1 8:1 / / rw shared:1 ext4 /dev/sda1 rw",
+		"22 1 8:1 / / rw - ext4 /dev/sda1",
+		"x 1 8:1 / / rw - ext4 /dev/sda1 rw",
+		"22 y 8:1 / / rw - ext4 /dev/sda1 rw",
+		"22 1 81 / / rw - ext4 /dev/sda1 rw",
+		"22 1 8:z / / rw - ext4 /dev/sda1 rw",
+		"22 1 8:1 /",
+	}
+	for _, line := range lines {
+		if _, err := ParseMountInfo(strings.NewReader(line)); err == nil {
+			t.Errorf("Accepted invalid mountinfo line: %q", line)
+		}
+	}
+}
+
+// mountIDs returns the IDs of the mounts, in order
+func mountIDs(mounts []*MountInfo) []int {
+	var ids []int
+	for _, info := range mounts {
+		ids = append(ids, info.ID)
+	}
+	return ids
+}
+
+func TestSortForUnmount(t *testing.T) {
+	// Listed in mount order, except for 35 which was moved beneath 31 after
+	// its children were mounted
+	table := strings.Join([]string{
+		"30 1 0:40 / /build rw - tmpfs tmpfs rw",
+		"31 30 0:41 / /build/root rw - tmpfs tmpfs rw",
+		"32 31 0:42 / /build/root/proc rw - proc proc rw",
+		"33 31 0:43 / /build/root/dev rw - devtmpfs devtmpfs rw",
+		"34 33 0:44 / /build/root/dev/pts rw - devpts devpts rw",
+		"36 35 0:46 / /build/root/srv/data rw - tmpfs tmpfs rw",
+		"35 31 0:45 / /build/root/srv rw - tmpfs tmpfs rw",
+		// Stacked over /build/root/proc, and then again on top of that
+		"37 32 0:47 / /build/root/proc rw - tmpfs tmpfs rw",
+		"38 37 0:48 / /build/root/proc rw - tmpfs tmpfs rw",
+	}, "\n")
+	mounts, err := ParseMountInfo(strings.NewReader(table))
+	if err != nil {
+		t.Fatalf("Failed to parse mountinfo: %v", err)
+	}
+	sortForUnmount(mounts)
+
+	pos := make(map[int]int)
+	for i, info := range mounts {
+		pos[info.ID] = i
+	}
+	for _, info := range mounts {
+		parent, ok := pos[info.ParentID]
+		if ok && parent < pos[info.ID] {
+			t.Errorf("Mount %d is unmounted before its child %d: %v", info.ParentID, info.ID, mountIDs(mounts))
+		}
+	}
+	// The stack at proc comes down from the top
+	if !(pos[38] < pos[37] && pos[37] < pos[32]) {
+		t.Errorf("Stacked mounts are not in reverse mount order: %v", mountIDs(mounts))
+	}
+	if last := mounts[len(mounts)-1].ID; last != 30 {
+		t.Errorf("Expected the topmost mount 30 last, got %d: %v", last, mountIDs(mounts))
+	}
+}
+
+func TestIsPathBeneath(t *testing.T) {
+	paths := []struct {
+		path    string
+		root    string
+		beneath bool
+	}{
+		{"/build/root", "/build/root", true},
+		{"/build/root/proc", "/build/root", true},
+		{"/build/rootfs", "/build/root", false},
+		{"/build", "/build/root", false},
+		{"/anything", "/", true},
+	}
+	for _, p := range paths {
+		if beneath := isPathBeneath(p.path, p.root); beneath != p.beneath {
+			t.Errorf("isPathBeneath(%q, %q) = %v, expected %v", p.path, p.root, beneath, p.beneath)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"strings"
+	"syscall"
+)
+
+// MountPropagation controls how mount and unmount events propagate between
+// a mountpoint and its peers.
+type MountPropagation int
+
+const (
+	// PropagationDefault leaves the propagation type as inherited from the
+	// parent mount, unless SetPrivateMounts has been enabled on the manager,
+	// in which case the mount is made private.
+	PropagationDefault MountPropagation = iota
+
+	// PropagationPrivate neither receives nor forwards mount events
+	PropagationPrivate
+
+	// PropagationRPrivate applies PropagationPrivate to all submounts too
+	PropagationRPrivate
+
+	// PropagationSlave receives mount events from the master, but doesn't
+	// forward any events of its own.
+	PropagationSlave
+
+	// PropagationRSlave applies PropagationSlave to all submounts too
+	PropagationRSlave
+
+	// PropagationShared both receives and forwards mount events with peers
+	PropagationShared
+
+	// PropagationRShared applies PropagationShared to all submounts too
+	PropagationRShared
+
+	// PropagationUnbindable is private, and also may not be bind mounted
+	PropagationUnbindable
+
+	// PropagationRUnbindable applies PropagationUnbindable to all submounts too
+	PropagationRUnbindable
+)
+
+// flags returns the mount(2) flags required to apply the propagation type
+func (p MountPropagation) flags() uintptr {
+	switch p {
+	case PropagationPrivate:
+		return syscall.MS_PRIVATE
+	case PropagationRPrivate:
+		return syscall.MS_PRIVATE | syscall.MS_REC
+	case PropagationSlave:
+		return syscall.MS_SLAVE
+	case PropagationRSlave:
+		return syscall.MS_SLAVE | syscall.MS_REC
+	case PropagationShared:
+		return syscall.MS_SHARED
+	case PropagationRShared:
+		return syscall.MS_SHARED | syscall.MS_REC
+	case PropagationUnbindable:
+		return syscall.MS_UNBINDABLE
+	case PropagationRUnbindable:
+		return syscall.MS_UNBINDABLE | syscall.MS_REC
+	default:
+		return 0
+	}
+}
+
+// MountOptions control how an individual mount is performed by the MountManager
+type MountOptions struct {
+	Flags       uintptr          // mount(2) flags, i.e. syscall.MS_NOSUID
+	Data        string           // Filesystem specific data, i.e. "mode=0755"
+	Propagation MountPropagation // Propagation to apply once mounted
+	Bind        bool             // Whether this is a bind mount
+	Recursive   bool             // Bind all submounts of the source too (rbind)
+}
+
+// mountFlagOptions maps the generic mount(8) style option names to the flags
+// they set or clear.
+var mountFlagOptions = map[string]struct {
+	flag  uintptr
+	clear bool
+}{
+	"ro":          {syscall.MS_RDONLY, false},
+	"rw":          {syscall.MS_RDONLY, true},
+	"nosuid":      {syscall.MS_NOSUID, false},
+	"suid":        {syscall.MS_NOSUID, true},
+	"nodev":       {syscall.MS_NODEV, false},
+	"dev":         {syscall.MS_NODEV, true},
+	"noexec":      {syscall.MS_NOEXEC, false},
+	"exec":        {syscall.MS_NOEXEC, true},
+	"sync":        {syscall.MS_SYNCHRONOUS, false},
+	"async":       {syscall.MS_SYNCHRONOUS, true},
+	"dirsync":     {syscall.MS_DIRSYNC, false},
+	"noatime":     {syscall.MS_NOATIME, false},
+	"atime":       {syscall.MS_NOATIME, true},
+	"nodiratime":  {syscall.MS_NODIRATIME, false},
+	"diratime":    {syscall.MS_NODIRATIME, true},
+	"relatime":    {syscall.MS_RELATIME, false},
+	"norelatime":  {syscall.MS_RELATIME, true},
+	"strictatime": {syscall.MS_STRICTATIME, false},
+}
+
+// mountPropagationOptions maps the mount(8) propagation names to their types
+var mountPropagationOptions = map[string]MountPropagation{
+	"private":     PropagationPrivate,
+	"rprivate":    PropagationRPrivate,
+	"slave":       PropagationSlave,
+	"rslave":      PropagationRSlave,
+	"shared":      PropagationShared,
+	"rshared":     PropagationRShared,
+	"unbindable":  PropagationUnbindable,
+	"runbindable": PropagationRUnbindable,
+}
+
+// ParseMountOptions will convert mount(8) style option strings, such as
+// "nosuid,nodev" or "mode=0755", into a MountOptions. Generic options are
+// converted into their flags, and anything unknown is passed through as
+// filesystem specific data.
+func ParseMountOptions(options ...string) *MountOptions {
+	ret := &MountOptions{}
+	var data []string
+
+	for _, opts := range options {
+		for _, opt := range strings.Split(opts, ",") {
+			opt = strings.TrimSpace(opt)
+			if opt == "" || opt == "defaults" {
+				continue
+			}
+			if f, ok := mountFlagOptions[opt]; ok {
+				if f.clear {
+					ret.Flags &^= f.flag
+				} else {
+					ret.Flags |= f.flag
+				}
+				continue
+			}
+			if p, ok := mountPropagationOptions[opt]; ok {
+				ret.Propagation = p
+				continue
+			}
+			switch opt {
+			case "bind":
+				ret.Bind = true
+			case "rbind":
+				ret.Bind = true
+				ret.Recursive = true
+			default:
+				data = append(data, opt)
+			}
+		}
+	}
+	ret.Data = strings.Join(data, ",")
+	return ret
+}
@@ -0,0 +1,205 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// OverlayOptions describe the layers and features of an overlayfs mount
+type OverlayOptions struct {
+	LowerDirs   []string // Read-only layers, uppermost first
+	UpperDir    string   // Writable layer, leave empty for a read-only overlay
+	WorkDir     string   // Scratch directory on the same filesystem as UpperDir
+	Volatile    bool     // Never sync the upper layer, for throwaway layers
+	Index       string   // The "index" feature, "on" or "off". Kernel default if empty
+	RedirectDir string   // The "redirect_dir" feature, i.e. "on" or "follow". Kernel default if empty
+	Flags       uintptr  // Additional mount(2) flags
+}
+
+// escapeOverlayPath will escape a layer path for use in the overlay options
+func escapeOverlayPath(path string) (string, error) {
+	if strings.Contains(path, ",") {
+		return "", fmt.Errorf("Overlay layer path cannot contain a comma: %v", path)
+	}
+	path = strings.Replace(path, "\\", "\\\\", -1)
+	return strings.Replace(path, ":", "\\:", -1), nil
+}
+
+// data returns the filesystem data string for the overlay mount
+func (o *OverlayOptions) data() (string, error) {
+	if len(o.LowerDirs) == 0 {
+		return "", errors.New("Overlay requires at least one lower directory")
+	}
+	if (o.UpperDir == "") != (o.WorkDir == "") {
+		return "", errors.New("Overlay requires both an upper and work directory, or neither")
+	}
+	if o.UpperDir == "" && len(o.LowerDirs) < 2 {
+		return "", errors.New("Read-only overlay requires at least two lower directories")
+	}
+
+	var lowers []string
+	for _, dir := range o.LowerDirs {
+		p, err := escapeOverlayPath(dir)
+		if err != nil {
+			return "", err
+		}
+		lowers = append(lowers, p)
+	}
+	opts := []string{"lowerdir=" + strings.Join(lowers, ":")}
+
+	if o.UpperDir != "" {
+		upper, err := escapeOverlayPath(o.UpperDir)
+		if err != nil {
+			return "", err
+		}
+		work, err := escapeOverlayPath(o.WorkDir)
+		if err != nil {
+			return "", err
+		}
+		opts = append(opts, "upperdir="+upper, "workdir="+work)
+		if o.Volatile {
+			opts = append(opts, "volatile")
+		}
+	}
+	if o.Index != "" {
+		opts = append(opts, "index="+o.Index)
+	}
+	if o.RedirectDir != "" {
+		opts = append(opts, "redirect_dir="+o.RedirectDir)
+	}
+	return strings.Join(opts, ","), nil
+}
+
+// MountOverlay will mount an overlayfs at destpath using the given layers.
+// The upper and work directories are created if they don't yet exist.
+func (m *MountManager) MountOverlay(destpath string, options *OverlayOptions) error {
+	data, err := options.data()
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{options.UpperDir, options.WorkDir} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 00755); err != nil {
+			return err
+		}
+	}
+	return m.MountWithOptions("overlay", destpath, "overlay", &MountOptions{
+		Flags: options.Flags,
+		Data:  data,
+	})
+}
+
+// A LayeredRoot is a throwaway writable layer over a cached base root, which
+// allows many variants to be built from one base without reinstalling it.
+type LayeredRoot struct {
+	Base    string // The read-only base root
+	Path    string // Where the writable root is mounted
+	manager *MountManager
+	scratch string  // Holds the upper and work directories
+	flags   uintptr // mount(2) flags the overlay was mounted with
+}
+
+// NewLayeredRoot will mount a writable overlay of the base root at path. All
+// changes are stored in a temporary directory created within scratchDir, which
+// must be on a filesystem that supports overlayfs upper layers, and are thrown
+// away by Close unless they are first committed.
+func (m *MountManager) NewLayeredRoot(base, path, scratchDir string) (*LayeredRoot, error) {
+	if err := os.MkdirAll(scratchDir, 00755); err != nil {
+		return nil, err
+	}
+	scratch, err := ioutil.TempDir(scratchDir, "layer-")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path, 00755); err != nil {
+		os.RemoveAll(scratch)
+		return nil, err
+	}
+	l := &LayeredRoot{
+		Base:    base,
+		Path:    path,
+		manager: m,
+		scratch: scratch,
+	}
+	opts := &OverlayOptions{
+		LowerDirs: []string{base},
+		UpperDir:  l.UpperDir(),
+		WorkDir:   filepath.Join(scratch, "work"),
+		Volatile:  true,
+	}
+	err = m.MountOverlay(path, opts)
+	// volatile requires Linux 5.10, and is only an optimisation
+	if merr, ok := err.(*MountError); ok && merr.Err == syscall.EINVAL {
+		opts.Volatile = false
+		err = m.MountOverlay(path, opts)
+	}
+	if err != nil {
+		os.RemoveAll(scratch)
+		return nil, err
+	}
+	l.flags = opts.Flags
+	return l, nil
+}
+
+// UpperDir returns the directory holding all changes made to the root
+func (l *LayeredRoot) UpperDir() string {
+	return filepath.Join(l.scratch, "upper")
+}
+
+// Commit will copy the upper layer, containing only the changes made over the
+// base, into the new directory dest. Deletions are preserved as overlayfs
+// whiteouts, so dest may itself be used as a lower layer over the same base.
+//
+// The root is remounted read-only for the duration of the copy, so Commit
+// fails if anything still has files open for writing within it.
+func (l *LayeredRoot) Commit(dest string) (err error) {
+	if _, err := os.Lstat(dest); err == nil {
+		return fmt.Errorf("Cannot commit layer to existing path: %v", dest)
+	}
+	// Stop the layer changing beneath us while it is copied
+	if err := syscall.Mount("", l.Path, "", syscall.MS_REMOUNT|syscall.MS_RDONLY|l.flags, ""); err != nil {
+		return fmt.Errorf("Failed to remount %v read-only: %v", l.Path, err)
+	}
+	defer func() {
+		rerr := syscall.Mount("", l.Path, "", syscall.MS_REMOUNT|l.flags, "")
+		if rerr != nil && err == nil {
+			err = fmt.Errorf("Failed to remount %v read-write: %v", l.Path, rerr)
+		}
+	}()
+
+	// A volatile overlay never syncs the upper layer itself
+	syscall.Sync()
+	return CopyTree(l.UpperDir(), dest, nil)
+}
+
+// Close will unmount the root, along with anything mounted within it, and
+// throw away all uncommitted changes.
+func (l *LayeredRoot) Close() error {
+	if err := l.manager.UnmountTree(l.Path); err != nil {
+		return err
+	}
+	return os.RemoveAll(l.scratch)
+}
@@ -0,0 +1,435 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// GUID is a globally unique identifier, stored in the mixed-endian format
+// used on disk by GPT.
+type GUID [16]byte
+
+// ParseGUID will parse the canonical form of a GUID, such as
+// "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != 16 || len(s) != 36 {
+		return g, fmt.Errorf("Invalid GUID: %v", s)
+	}
+	// The first three groups are stored little endian
+	binary.LittleEndian.PutUint32(g[0:4], binary.BigEndian.Uint32(b[0:4]))
+	binary.LittleEndian.PutUint16(g[4:6], binary.BigEndian.Uint16(b[4:6]))
+	binary.LittleEndian.PutUint16(g[6:8], binary.BigEndian.Uint16(b[6:8]))
+	copy(g[8:], b[8:])
+	return g, nil
+}
+
+// mustParseGUID is used to initialise the well known GUIDs
+func mustParseGUID(s string) GUID {
+	g, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// String returns the canonical form of the GUID
+func (g GUID) String() string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		g[8:10], g[10:16])
+}
+
+// IsZero determines whether the GUID is unset
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
+
+// setVersion4 marks the GUID as a random (version 4) GUID
+func (g *GUID) setVersion4() {
+	g[7] = (g[7] & 0x0f) | 0x40
+	g[8] = (g[8] & 0x3f) | 0x80
+}
+
+// NewRandomGUID will return a new random GUID
+func NewRandomGUID() (GUID, error) {
+	var g GUID
+	if _, err := io.ReadFull(rand.Reader, g[:]); err != nil {
+		return g, err
+	}
+	g.setVersion4()
+	return g, nil
+}
+
+// deriveGUID will deterministically derive a new GUID from the seed, so that
+// reproducible images get the same partition GUIDs every time.
+func deriveGUID(seed GUID, purpose string, index int) GUID {
+	h := sha256.New()
+	h.Write(seed[:])
+	fmt.Fprintf(h, "%s:%d", purpose, index)
+	var g GUID
+	copy(g[:], h.Sum(nil))
+	g.setVersion4()
+	return g
+}
+
+var (
+	// PartitionTypeESP is the EFI System Partition
+	PartitionTypeESP = mustParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+
+	// PartitionTypeBIOSBoot is the BIOS boot partition used by GRUB on GPT
+	PartitionTypeBIOSBoot = mustParseGUID("21686148-6449-6E6F-744E-656564454649")
+
+	// PartitionTypeXBOOTLDR is the extended boot loader partition
+	PartitionTypeXBOOTLDR = mustParseGUID("BC13C2FF-59E6-4262-A352-B275FD6F7172")
+
+	// PartitionTypeLinuxFilesystem is a generic Linux data partition
+	PartitionTypeLinuxFilesystem = mustParseGUID("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+
+	// PartitionTypeLinuxRootAMD64 is the Linux root partition for x86-64
+	PartitionTypeLinuxRootAMD64 = mustParseGUID("4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709")
+
+	// PartitionTypeLinuxRootX86 is the Linux root partition for 32-bit x86
+	PartitionTypeLinuxRootX86 = mustParseGUID("44479540-F297-41B2-9AF7-D131D5F0458A")
+
+	// PartitionTypeLinuxRootARM64 is the Linux root partition for 64-bit ARM
+	PartitionTypeLinuxRootARM64 = mustParseGUID("B921B045-1DF0-41C3-AF44-4C6F280D3FAE")
+
+	// PartitionTypeLinuxHome is the Linux /home partition
+	PartitionTypeLinuxHome = mustParseGUID("933AC7E1-2EB4-4F13-B844-0E14E2AEF915")
+
+	// PartitionTypeLinuxSwap is a Linux swap partition
+	PartitionTypeLinuxSwap = mustParseGUID("0657FD6D-A4AB-43C4-84E5-0933C84B4F4F")
+)
+
+// MBR partition type IDs
+const (
+	// MBRTypeLinux is a Linux data partition
+	MBRTypeLinux byte = 0x83
+
+	// MBRTypeLinuxSwap is a Linux swap partition
+	MBRTypeLinuxSwap byte = 0x82
+
+	// MBRTypeESP is the EFI System Partition
+	MBRTypeESP byte = 0xEF
+
+	// MBRTypeProtective is the single partition in the protective MBR of a GPT disk
+	MBRTypeProtective byte = 0xEE
+)
+
+// GPT partition attribute bits
+const (
+	// PartitionAttrRequired marks the partition as required for the platform
+	PartitionAttrRequired uint64 = 1 << 0
+
+	// PartitionAttrNoBlockIO tells EFI not to produce a block IO protocol
+	PartitionAttrNoBlockIO uint64 = 1 << 1
+
+	// PartitionAttrLegacyBIOSBootable is the GPT equivalent of the MBR active flag
+	PartitionAttrLegacyBIOSBootable uint64 = 1 << 2
+
+	// PartitionAttrReadOnly asks for the partition to be mounted read-only
+	PartitionAttrReadOnly uint64 = 1 << 60
+
+	// PartitionAttrHidden hides the partition from automatic discovery
+	PartitionAttrHidden uint64 = 1 << 62
+
+	// PartitionAttrNoAutomount prevents the partition being automatically mounted
+	PartitionAttrNoAutomount uint64 = 1 << 63
+)
+
+// PartitionTableType is the format of a partition table
+type PartitionTableType string
+
+const (
+	// PartitionTableGPT is a GUID Partition Table with a protective MBR
+	PartitionTableGPT PartitionTableType = "gpt"
+
+	// PartitionTableMBR is a legacy DOS partition table
+	PartitionTableMBR PartitionTableType = "mbr"
+)
+
+const (
+	// DefaultPartitionAlignment is where partitions are aligned to by default
+	DefaultPartitionAlignment = MiB
+
+	// DefaultSectorSize is the logical sector size used by default
+	DefaultSectorSize = 512
+)
+
+// A PartitionSpec describes a single partition in a PartitionLayout.
+//
+// The size is either a fixed Size, or a Percent of the usable disk space. If
+// both are zero the partition will take up all remaining space, which is
+// only permitted for the final partition.
+type PartitionSpec struct {
+	Name       string  // GPT partition name, up to 36 characters
+	Type       GUID    // GPT partition type, PartitionTypeLinuxFilesystem if unset
+	MBRType    byte    // MBR partition type, derived from Type if unset
+	Size       Size    // Fixed size, rounded up to the alignment
+	Percent    float64 // Percentage of the usable disk space, when Size is unset
+	GUID       GUID    // Unique partition GUID, generated if unset
+	Attributes uint64  // GPT attribute bits, i.e. PartitionAttrReadOnly
+	Bootable   bool    // MBR active flag, or the GPT legacy BIOS bootable attribute
+}
+
+// A PartitionLayout describes a complete partition table to be written
+type PartitionLayout struct {
+	Table      PartitionTableType // GPT or MBR, defaults to GPT
+	DiskGUID   GUID               // Fixed disk GUID for reproducibility, random if unset
+	Alignment  Size               // Partition alignment, DefaultPartitionAlignment if unset
+	SectorSize int                // Logical sector size, DefaultSectorSize if unset. MBR is always 512
+	Partitions []*PartitionSpec   // The partitions, in order
+}
+
+// A Partition is a partition within a PartitionTable
+type Partition struct {
+	Number     int    // Partition number, starting at 1
+	Start      uint64 // Offset of the partition in bytes
+	Size       uint64 // Length of the partition in bytes
+	Type       GUID   // GPT partition type
+	MBRType    byte   // MBR partition type
+	GUID       GUID   // GPT unique partition GUID
+	Name       string // GPT partition name
+	Attributes uint64 // GPT attribute bits
+	Bootable   bool   // MBR active flag, or the GPT legacy BIOS bootable attribute
+}
+
+// A PartitionTable is the partition table found on, or written to, a disk
+type PartitionTable struct {
+	Type       PartitionTableType // GPT or MBR
+	DiskGUID   GUID               // GPT disk GUID
+	Signature  uint32             // MBR disk signature
+	SectorSize int                // Logical sector size
+	DiskSize   uint64             // Size of the disk in bytes
+	Partitions []*Partition       // All partitions, in table order
+}
+
+// mbrTypeFor returns the MBR type that best matches the GPT type
+func mbrTypeFor(t GUID) byte {
+	switch t {
+	case PartitionTypeESP:
+		return MBRTypeESP
+	case PartitionTypeLinuxSwap:
+		return MBRTypeLinuxSwap
+	default:
+		return MBRTypeLinux
+	}
+}
+
+// diskSize returns the size of the image file or block device
+func diskSize(f *os.File) (uint64, error) {
+	sz, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(sz), nil
+}
+
+// withDefaults returns a copy of the layout with the defaults filled in, and
+// every GUID set.
+func (l *PartitionLayout) withDefaults() (*PartitionLayout, error) {
+	ret := *l
+	if ret.Table == "" {
+		ret.Table = PartitionTableGPT
+	}
+	if ret.Table != PartitionTableGPT && ret.Table != PartitionTableMBR {
+		return nil, fmt.Errorf("Unknown partition table type: %v", ret.Table)
+	}
+	if ret.Alignment == 0 {
+		ret.Alignment = DefaultPartitionAlignment
+	}
+	if ret.SectorSize == 0 {
+		ret.SectorSize = DefaultSectorSize
+	}
+	if ret.SectorSize < 512 || ret.SectorSize&(ret.SectorSize-1) != 0 {
+		return nil, fmt.Errorf("Invalid sector size: %v", ret.SectorSize)
+	}
+	// Nothing in an MBR records the sector size, so it couldn't be read back
+	if ret.Table == PartitionTableMBR && ret.SectorSize != DefaultSectorSize {
+		return nil, fmt.Errorf("MBR requires %d byte sectors, not %v", DefaultSectorSize, ret.SectorSize)
+	}
+	if ret.Alignment%Size(ret.SectorSize) != 0 {
+		return nil, fmt.Errorf("Alignment %v is not a multiple of the sector size", ret.Alignment)
+	}
+
+	// Random GUIDs unless the disk GUID is fixed, in which case everything is
+	// derived from it to keep the image reproducible
+	reproducible := !ret.DiskGUID.IsZero()
+	if !reproducible {
+		g, err := NewRandomGUID()
+		if err != nil {
+			return nil, err
+		}
+		ret.DiskGUID = g
+	}
+
+	ret.Partitions = nil
+	for i, spec := range l.Partitions {
+		p := *spec
+		if p.Type.IsZero() {
+			p.Type = PartitionTypeLinuxFilesystem
+		}
+		if p.MBRType == 0 {
+			p.MBRType = mbrTypeFor(p.Type)
+		}
+		if p.GUID.IsZero() {
+			if reproducible {
+				p.GUID = deriveGUID(ret.DiskGUID, "partition", i+1)
+			} else {
+				g, err := NewRandomGUID()
+				if err != nil {
+					return nil, err
+				}
+				p.GUID = g
+			}
+		}
+		if p.Percent < 0 || p.Percent > 100 {
+			return nil, fmt.Errorf("Invalid percentage for partition %d: %v", i+1, p.Percent)
+		}
+		if p.Size == 0 && p.Percent == 0 && i != len(l.Partitions)-1 {
+			return nil, fmt.Errorf("Only the final partition may fill the remaining space")
+		}
+		ret.Partitions = append(ret.Partitions, &p)
+	}
+	return &ret, nil
+}
+
+// allocate will lay out the partitions between the first and last usable
+// bytes of the disk, returning the partition table.
+func (l *PartitionLayout) allocate(firstUsable, lastUsable, diskSize uint64) (*PartitionTable, error) {
+	start := Size(firstUsable).alignUp(l.Alignment)
+	// lastUsable is inclusive
+	end := Size(lastUsable + 1)
+	if uint64(start) >= uint64(end) {
+		return nil, errors.New("Disk is too small for a partition table")
+	}
+	usable := uint64(end - start)
+
+	table := &PartitionTable{
+		Type:       l.Table,
+		DiskGUID:   l.DiskGUID,
+		Signature:  binary.LittleEndian.Uint32(l.DiskGUID[0:4]),
+		SectorSize: l.SectorSize,
+		DiskSize:   diskSize,
+	}
+
+	for i, spec := range l.Partitions {
+		var length Size
+		switch {
+		case spec.Size != 0:
+			length = spec.Size.alignUp(l.Alignment)
+		case spec.Percent != 0:
+			length = Size(float64(usable) * spec.Percent / 100).alignDown(l.Alignment)
+		default:
+			// Fill the rest, keeping the end of the partition aligned
+			length = (end - start).alignDown(l.Alignment)
+			if length == 0 {
+				length = end - start
+			}
+		}
+		if length == 0 || uint64(start)+uint64(length) > uint64(end) {
+			return nil, fmt.Errorf("Partition %d does not fit on the disk", i+1)
+		}
+		table.Partitions = append(table.Partitions, &Partition{
+			Number:     i + 1,
+			Start:      uint64(start),
+			Size:       uint64(length),
+			Type:       spec.Type,
+			MBRType:    spec.MBRType,
+			GUID:       spec.GUID,
+			Name:       spec.Name,
+			Attributes: spec.Attributes,
+			Bootable:   spec.Bootable,
+		})
+		start = (start + length).alignUp(l.Alignment)
+	}
+	return table, nil
+}
+
+// WritePartitionTable will write a new partition table to the image file or
+// device, according to the layout, returning the resulting table. Any
+// existing partition table is overwritten.
+func WritePartitionTable(filename string, layout *PartitionLayout) (*PartitionTable, error) {
+	l, err := layout.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size, err := diskSize(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var table *PartitionTable
+	switch l.Table {
+	case PartitionTableMBR:
+		table, err = writeMBR(f, l, size)
+	default:
+		table, err = writeGPT(f, l, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Sync(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// ReadPartitionTable will read the GPT or MBR partition table from the image
+// file or device. Where a GPT is found, the protective MBR is ignored.
+func ReadPartitionTable(filename string) (*PartitionTable, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size, err := diskSize(f)
+	if err != nil {
+		return nil, err
+	}
+	mbr := make([]byte, 512)
+	if _, err = f.ReadAt(mbr, 0); err != nil {
+		return nil, err
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xAA {
+		return nil, fmt.Errorf("No partition table found on %v", filename)
+	}
+	if isProtectiveMBR(mbr) {
+		return readGPT(f, size)
+	}
+	return readMBR(mbr, size)
+}
@@ -0,0 +1,96 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// hasMagic determines whether the magic bytes are found at the offset. A
+// file too short to contain them simply doesn't match.
+func hasMagic(filename string, offset int64, magic []byte) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	buf := make([]byte, len(magic))
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(buf, magic), nil
+}
+
+// probeExt4 looks for the ext2/3/4 superblock magic, 0xEF53
+func probeExt4(filename string) (bool, error) {
+	return hasMagic(filename, 1024+0x38, []byte{0x53, 0xEF})
+}
+
+// probeVfat looks for the boot sector signature along with the filesystem
+// type, which lives at 0x52 for FAT32 and at 0x36 for FAT12 and FAT16.
+func probeVfat(filename string) (bool, error) {
+	if found, err := hasMagic(filename, 510, []byte{0x55, 0xAA}); err != nil || !found {
+		return false, err
+	}
+	types := []struct {
+		offset int64
+		magic  string
+	}{
+		{0x52, "FAT32   "},
+		{0x36, "FAT16   "},
+		{0x36, "FAT12   "},
+	}
+	for _, t := range types {
+		found, err := hasMagic(filename, t.offset, []byte(t.magic))
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// probeBtrfs looks for the btrfs magic in the superblock at 64KiB
+func probeBtrfs(filename string) (bool, error) {
+	return hasMagic(filename, 0x10000+0x40, []byte("_BHRfS_M"))
+}
+
+// probeXfs looks for the XFS superblock magic at the start of the device
+func probeXfs(filename string) (bool, error) {
+	return hasMagic(filename, 0, []byte("XFSB"))
+}
+
+// probeF2fs looks for the f2fs superblock magic, 0xF2F52010
+func probeF2fs(filename string) (bool, error) {
+	return hasMagic(filename, 1024, []byte{0x10, 0x20, 0xF5, 0xF2})
+}
+
+// probeSwap looks for the swap signature for either the native or the
+// common 4KiB page size.
+func probeSwap(filename string) (bool, error) {
+	for _, pageSize := range []int{os.Getpagesize(), 4096} {
+		found, err := hasMagic(filename, int64(pageSize-len(swapSignature)), []byte(swapSignature))
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,299 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// ProcessKillTimeout is how long to wait for killed processes to exit
+	ProcessKillTimeout = 5 * time.Second
+
+	// processPollTime is the interval to poll for killed processes exiting
+	processPollTime = 100 * time.Millisecond
+)
+
+// ProcessAccess describes how a process is using a path, as with fuser(1)
+type ProcessAccess int
+
+const (
+	// AccessRoot means the process is chrooted at or beneath the path
+	AccessRoot ProcessAccess = 1 << iota
+
+	// AccessCwd means the working directory is at or beneath the path
+	AccessCwd
+
+	// AccessExe means the process is running an executable from the path
+	AccessExe
+
+	// AccessFile means the process has a file open beneath the path
+	AccessFile
+
+	// AccessMmap means the process has a file from the path mapped, such as
+	// a shared library
+	AccessMmap
+)
+
+// accessNames are the human readable names for each type of access
+var accessNames = []struct {
+	access ProcessAccess
+	name   string
+}{
+	{AccessRoot, "root"},
+	{AccessCwd, "cwd"},
+	{AccessExe, "exe"},
+	{AccessFile, "file"},
+	{AccessMmap, "mmap"},
+}
+
+// String returns the set access types, i.e. "cwd,file"
+func (a ProcessAccess) String() string {
+	var names []string
+	for _, n := range accessNames {
+		if a&n.access == n.access {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// A Process is a running process found via /proc
+type Process struct {
+	PID    int           // Process ID
+	Name   string        // Command name, from /proc/$pid/comm
+	Access ProcessAccess // How the process is using the path it was found by
+}
+
+// listPIDs will return the IDs of every visible process, excluding our own
+func listPIDs() ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	self := os.Getpid()
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// String returns a human readable description of the process
+func (p *Process) String() string {
+	if p.Access != 0 {
+		return fmt.Sprintf("%d (%s: %v)", p.PID, p.Name, p.Access)
+	}
+	return fmt.Sprintf("%d (%s)", p.PID, p.Name)
+}
+
+// newProcess returns a Process for the given pid
+func newProcess(pid int) *Process {
+	p := &Process{PID: pid}
+	if b, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm")); err == nil {
+		p.Name = strings.TrimSpace(string(b))
+	}
+	return p
+}
+
+// procLinkBeneath determines whether the given /proc/$pid link points at or
+// beneath the path.
+func procLinkBeneath(pid int, link, path string) bool {
+	target, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), link))
+	if err != nil {
+		return false
+	}
+	return isPathBeneath(target, path)
+}
+
+// ProcessesInRoot will return all processes whose root directory is at or
+// beneath the given root, i.e. everything that was chrooted into it. The
+// host root "/" is refused, as that would match every process.
+func ProcessesInRoot(root string) ([]*Process, error) {
+	rpath, err := resolveMountPath(root)
+	if err != nil {
+		return nil, err
+	}
+	if rpath == "/" {
+		return nil, fmt.Errorf("Refusing to find processes in the host root: %v", root)
+	}
+	pids, err := listPIDs()
+	if err != nil {
+		return nil, err
+	}
+	var procs []*Process
+	for _, pid := range pids {
+		if procLinkBeneath(pid, "root", rpath) {
+			p := newProcess(pid)
+			p.Access = AccessRoot
+			procs = append(procs, p)
+		}
+	}
+	return procs, nil
+}
+
+// processMapsBeneath determines whether the process has any files at or
+// beneath the path mapped into memory.
+func processMapsBeneath(pid int, path string) bool {
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "maps"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// The pathname is the sixth field, and may itself contain spaces
+		fields := strings.SplitN(sc.Text(), " ", 6)
+		if len(fields) < 6 {
+			continue
+		}
+		mapped := strings.TrimSuffix(strings.TrimSpace(fields[5]), " (deleted)")
+		if strings.HasPrefix(mapped, "/") && isPathBeneath(mapped, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// processAccess determines how the process is using the path, if at all
+func processAccess(pid int, path string) ProcessAccess {
+	var access ProcessAccess
+	if procLinkBeneath(pid, "root", path) {
+		access |= AccessRoot
+	}
+	if procLinkBeneath(pid, "cwd", path) {
+		access |= AccessCwd
+	}
+	if procLinkBeneath(pid, "exe", path) {
+		access |= AccessExe
+	}
+	if fds, err := ioutil.ReadDir(filepath.Join("/proc", strconv.Itoa(pid), "fd")); err == nil {
+		for _, fd := range fds {
+			if procLinkBeneath(pid, filepath.Join("fd", fd.Name()), path) {
+				access |= AccessFile
+				break
+			}
+		}
+	}
+	if processMapsBeneath(pid, path) {
+		access |= AccessMmap
+	}
+	return access
+}
+
+// ProcessesUsingPath will find all processes keeping the given path busy,
+// through their root, working directory, executable, open or mapped files,
+// in the same fashion as fuser(1). The Access of each Process describes how
+// it is using the path.
+func ProcessesUsingPath(path string) ([]*Process, error) {
+	rpath, err := resolveMountPath(path)
+	if err != nil {
+		return nil, err
+	}
+	pids, err := listPIDs()
+	if err != nil {
+		return nil, err
+	}
+	var procs []*Process
+	for _, pid := range pids {
+		if access := processAccess(pid, rpath); access != 0 {
+			p := newProcess(pid)
+			p.Access = access
+			procs = append(procs, p)
+		}
+	}
+	return procs, nil
+}
+
+// KillProcessesInRoot will send SIGKILL to every process running inside the
+// root, and wait up to ProcessKillTimeout for them to go away.
+func KillProcessesInRoot(root string) error {
+	deadline := time.Now().Add(ProcessKillTimeout)
+	for {
+		procs, err := ProcessesInRoot(root)
+		if err != nil {
+			return err
+		}
+		if len(procs) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Processes still running in %v after %v", root, ProcessKillTimeout)
+		}
+		for _, p := range procs {
+			syscall.Kill(p.PID, syscall.SIGKILL)
+		}
+		time.Sleep(processPollTime)
+	}
+}
+
+// processAlive determines whether the process is still running, treating
+// zombies as dead as they no longer hold anything open.
+func processAlive(pid int) bool {
+	b, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	stat := string(b)
+	idx := strings.LastIndex(stat, ")")
+	if idx < 0 || idx+2 >= len(stat) {
+		return false
+	}
+	return stat[idx+2] != 'Z'
+}
+
+// TerminateProcesses will send SIGTERM to each of the processes, and then
+// SIGKILL to any that are still alive after the timeout has elapsed. With a
+// zero timeout, SIGKILL is sent straight away.
+func TerminateProcesses(procs []*Process, timeout time.Duration) {
+	if timeout > 0 {
+		for _, p := range procs {
+			syscall.Kill(p.PID, syscall.SIGTERM)
+		}
+		deadline := time.Now().Add(timeout)
+		for time.Now().Before(deadline) {
+			alive := false
+			for _, p := range procs {
+				if processAlive(p.PID) {
+					alive = true
+					break
+				}
+			}
+			if !alive {
+				return
+			}
+			time.Sleep(processPollTime)
+		}
+	}
+	for _, p := range procs {
+		if processAlive(p.PID) {
+			syscall.Kill(p.PID, syscall.SIGKILL)
+		}
+	}
+}
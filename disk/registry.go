@@ -0,0 +1,156 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"sync"
+)
+
+// A FilesystemResizeFunc will resize the filesystem to the given number of
+// bytes, or to fill the file or device when size is 0. Any temporary mounts
+// or loop devices needed along the way are made through m.
+type FilesystemResizeFunc func(m *MountManager, filename string, size uint64) error
+
+// A FilesystemMinimumSizeFunc returns the smallest size, in bytes, that the
+// filesystem can be shrunk to. Any temporary mounts or loop devices needed
+// along the way are made through m.
+type FilesystemMinimumSizeFunc func(m *MountManager, filename string) (uint64, error)
+
+// A FilesystemProbeFunc determines whether the filesystem is present on the
+// file or device, typically by looking for its superblock.
+type FilesystemProbeFunc func(filename string) (bool, error)
+
+// A Filesystem ties together everything needed to create and maintain a
+// filesystem type. Any of the functions may be nil when unsupported.
+type Filesystem struct {
+	Name        string                    // Name as passed to FormatAs and mount, i.e. "ext4"
+	Format      FilesystemFormatFunc      // Create a new filesystem
+	Check       FilesystemCheckFunc       // Check and repair the filesystem
+	Resize      FilesystemResizeFunc      // Grow or shrink the filesystem
+	MinimumSize FilesystemMinimumSizeFunc // Find how far it can shrink, nil if it can only grow
+	Probe       FilesystemProbeFunc       // Detect the filesystem
+	Tools       []string                  // Host tools used by the functions above
+}
+
+var (
+	filesystems     map[string]*Filesystem
+	filesystemsLock sync.RWMutex
+)
+
+// RegisterFilesystem will add the filesystem to the registry, making it
+// available to FormatAs, CheckFS and friends. Registering a name that is
+// already known replaces the existing filesystem, which allows the built in
+// implementations to be overridden.
+func RegisterFilesystem(fs *Filesystem) error {
+	if fs.Name == "" {
+		return errors.New("Cannot register a filesystem without a name")
+	}
+	filesystemsLock.Lock()
+	defer filesystemsLock.Unlock()
+	filesystems[fs.Name] = fs
+	return nil
+}
+
+// GetFilesystem will return the registered filesystem with the given name
+func GetFilesystem(name string) (*Filesystem, error) {
+	filesystemsLock.RLock()
+	defer filesystemsLock.RUnlock()
+	fs, ok := filesystems[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown filesystem '%v'", name)
+	}
+	return fs, nil
+}
+
+// SupportedFilesystems returns the names of all registered filesystems,
+// sorted alphabetically.
+func SupportedFilesystems() []string {
+	filesystemsLock.RLock()
+	defer filesystemsLock.RUnlock()
+	var ret []string
+	for name := range filesystems {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// MissingTools returns those Tools that can't be found in PATH
+func (f *Filesystem) MissingTools() []string {
+	var ret []string
+	for _, tool := range f.Tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			ret = append(ret, tool)
+		}
+	}
+	return ret
+}
+
+// RequiredTools returns the host tools needed for all of the given
+// filesystems, without duplicates, so builders can be preflighted.
+func RequiredTools(names ...string) ([]string, error) {
+	seen := make(map[string]bool)
+	var ret []string
+	for _, name := range names {
+		fs, err := GetFilesystem(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, tool := range fs.Tools {
+			if seen[tool] {
+				continue
+			}
+			seen[tool] = true
+			ret = append(ret, tool)
+		}
+	}
+	return ret, nil
+}
+
+// MissingTools returns the host tools needed for the given filesystems that
+// can't be found in PATH. An empty result means everything is available.
+func MissingTools(names ...string) ([]string, error) {
+	tools, err := RequiredTools(names...)
+	if err != nil {
+		return nil, err
+	}
+	fs := &Filesystem{Tools: tools}
+	return fs.MissingTools(), nil
+}
+
+// ProbeFilesystem will try each registered probe against the file or device,
+// returning the name of the filesystem found.
+func ProbeFilesystem(filename string) (string, error) {
+	for _, name := range SupportedFilesystems() {
+		fs, err := GetFilesystem(name)
+		if err != nil || fs.Probe == nil {
+			continue
+		}
+		found, err := fs.Probe(filename)
+		if err != nil {
+			return "", err
+		}
+		if found {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("No known filesystem found on %v", filename)
+}
@@ -0,0 +1,427 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/solus-project/libosdev/commands"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// isRegularFile determines whether filename is an image file, rather than
+// a block device.
+func isRegularFile(filename string) (bool, error) {
+	st, err := os.Stat(filename)
+	if err != nil {
+		return false, err
+	}
+	return st.Mode().IsRegular(), nil
+}
+
+// growFile will extend an image file to at least size bytes. Devices are
+// left alone.
+func growFile(filename string, size uint64) error {
+	st, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if !st.Mode().IsRegular() || uint64(st.Size()) >= size {
+		return nil
+	}
+	return os.Truncate(filename, int64(size))
+}
+
+// withTempMount will mount the filesystem at a temporary directory for the
+// duration of fn, for those tools that only work on a mounted filesystem.
+// Image files are attached to a loop device first.
+func (m *MountManager) withTempMount(filename, filesystem string, fn func(mountpoint string) error) error {
+	device := filename
+	regular, err := isRegularFile(filename)
+	if err != nil {
+		return err
+	}
+	if regular {
+		l, err := m.AttachLoop(filename, nil)
+		if err != nil {
+			return err
+		}
+		defer m.DetachLoop(l)
+		device = l.Path
+	}
+
+	dir, err := ioutil.TempDir("", "libosdev-resize-")
+	if err != nil {
+		return err
+	}
+	// Only removes the directory if it is empty, i.e. unmounted
+	defer os.Remove(dir)
+
+	if err = m.Mount(device, dir, filesystem); err != nil {
+		return err
+	}
+	err = fn(dir)
+	if uerr := m.Unmount(dir); uerr != nil && err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// ext4BlockSize reads the block size from the ext4 superblock
+func ext4BlockSize(filename string) (uint64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	b := make([]byte, 4)
+	// s_log_block_size
+	if _, err := f.ReadAt(b, 1024+24); err != nil {
+		return 0, err
+	}
+	return 1024 << binary.LittleEndian.Uint32(b), nil
+}
+
+// checkBeforeResize will ensure the ext4 filesystem is clean, which
+// resize2fs insists upon.
+func checkBeforeResize(filename string) error {
+	result, err := checkExt4(filename, CheckRepair)
+	if err != nil {
+		return err
+	}
+	if !result.OK() {
+		return fmt.Errorf("Cannot resize %v: %v", filename, result.Status)
+	}
+	return nil
+}
+
+func resizeExt4(m *MountManager, filename string, size uint64) error {
+	if err := checkBeforeResize(filename); err != nil {
+		return err
+	}
+	args := []string{filename}
+	if size != 0 {
+		args = append(args, fmt.Sprintf("%dK", size/1024))
+	}
+	return commands.ExecStdoutArgs("resize2fs", args)
+}
+
+func minimumSizeExt4(m *MountManager, filename string) (uint64, error) {
+	if err := checkBeforeResize(filename); err != nil {
+		return 0, err
+	}
+	out, err := commands.ExecOutputArgs("resize2fs", []string{"-P", filename})
+	if err != nil {
+		return 0, err
+	}
+	const prefix = "Estimated minimum size of the filesystem:"
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		blocks, err := strconv.ParseUint(strings.TrimSpace(line[len(prefix):]), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		blockSize, err := ext4BlockSize(filename)
+		if err != nil {
+			return 0, err
+		}
+		return blocks * blockSize, nil
+	}
+	return 0, fmt.Errorf("Failed to find minimum size of %v", filename)
+}
+
+func resizeBtrfs(m *MountManager, filename string, size uint64) error {
+	target := "max"
+	if size != 0 {
+		target = fmt.Sprintf("%d", size)
+	}
+	return m.withTempMount(filename, "btrfs", func(mountpoint string) error {
+		return commands.ExecStdoutArgs("btrfs", []string{"filesystem", "resize", target, mountpoint})
+	})
+}
+
+func minimumSizeBtrfs(m *MountManager, filename string) (uint64, error) {
+	var size uint64
+	err := m.withTempMount(filename, "btrfs", func(mountpoint string) error {
+		out, err := commands.ExecOutputArgs("btrfs", []string{"inspect-internal", "min-dev-size", mountpoint})
+		if err != nil {
+			return err
+		}
+		// i.e. "1234567 bytes (1.18MiB)"
+		fields := strings.Fields(out)
+		if len(fields) < 1 {
+			return fmt.Errorf("Failed to find minimum size of %v", filename)
+		}
+		size, err = strconv.ParseUint(fields[0], 10, 64)
+		return err
+	})
+	return size, err
+}
+
+// resizeXfs can only grow the filesystem, as XFS doesn't support shrinking
+func resizeXfs(m *MountManager, filename string, size uint64) error {
+	return m.withTempMount(filename, "xfs", func(mountpoint string) error {
+		args := []string{"-d", mountpoint}
+		if size != 0 {
+			var st syscall.Statfs_t
+			if err := syscall.Statfs(mountpoint, &st); err != nil {
+				return err
+			}
+			args = []string{"-D", fmt.Sprintf("%d", size/uint64(st.Bsize)), mountpoint}
+		}
+		return commands.ExecStdoutArgs("xfs_growfs", args)
+	})
+}
+
+// getResizableFilesystem returns the filesystem, ensuring it can be resized
+func getResizableFilesystem(filesystem string) (*Filesystem, error) {
+	fs, err := GetFilesystem(filesystem)
+	if err != nil || fs.Resize == nil {
+		return nil, fmt.Errorf("Cannot resize unsupported filesystem '%v'", filesystem)
+	}
+	return fs, nil
+}
+
+// shrinkTarget returns the size to shrink to, rounded up to a whole MiB
+func shrinkTarget(minimum, headroom uint64) uint64 {
+	return uint64(Size(minimum + headroom).alignUp(MiB))
+}
+
+// ResizeFS will resize the filesystem to size bytes, or grow it to fill the
+// file or device when size is 0. Image files are extended first when growing
+// beyond their current size, but never truncated.
+//
+// Filesystems without a MinimumSize function, such as xfs, can only grow.
+func (m *MountManager) ResizeFS(filename, filesystem string, size uint64) error {
+	fs, err := getResizableFilesystem(filesystem)
+	if err != nil {
+		return err
+	}
+	if size != 0 {
+		if err := growFile(filename, size); err != nil {
+			return err
+		}
+	}
+	return fs.Resize(m, filename, size)
+}
+
+// ShrinkFS will shrink the filesystem to its minimum size plus headroom
+// bytes, rounded up to a whole MiB, and truncate the image file to match.
+// The new size of the filesystem is returned.
+func (m *MountManager) ShrinkFS(filename, filesystem string, headroom uint64) (uint64, error) {
+	fs, err := getResizableFilesystem(filesystem)
+	if err != nil {
+		return 0, err
+	}
+	if fs.MinimumSize == nil {
+		return 0, fmt.Errorf("Cannot shrink filesystem '%v'", filesystem)
+	}
+	st, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	minimum, err := fs.MinimumSize(m, filename)
+	if err != nil {
+		return 0, err
+	}
+	size := shrinkTarget(minimum, headroom)
+	if st.Mode().IsRegular() && size >= uint64(st.Size()) {
+		return uint64(st.Size()), nil
+	}
+	if err = fs.Resize(m, filename, size); err != nil {
+		return 0, err
+	}
+	if st.Mode().IsRegular() {
+		if err = os.Truncate(filename, int64(size)); err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// finalPartition returns the partition with the given number, which must
+// be the last on the disk so that it is free to change size.
+func (t *PartitionTable) finalPartition(number int) (*Partition, error) {
+	var ret *Partition
+	for _, p := range t.Partitions {
+		if p.Number == number {
+			ret = p
+		}
+	}
+	if ret == nil {
+		return nil, fmt.Errorf("No such partition: %d", number)
+	}
+	for _, p := range t.Partitions {
+		if p.Start > ret.Start {
+			return nil, fmt.Errorf("Partition %d is not the final partition on the disk", number)
+		}
+	}
+	return ret, nil
+}
+
+// withPartitionLoop will attach the partition to its own loop device for the
+// duration of fn.
+func (m *MountManager) withPartitionLoop(filename string, start, size uint64, fn func(device string) error) error {
+	l, err := m.AttachLoop(filename, &LoopOptions{
+		Offset:    start,
+		SizeLimit: size,
+	})
+	if err != nil {
+		return err
+	}
+	err = fn(l.Path)
+	if derr := m.DetachLoop(l); derr != nil && err == nil {
+		err = derr
+	}
+	return err
+}
+
+// rewriteGPT will write the modified table back to the image file
+func rewriteGPT(filename string, table *PartitionTable) error {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = writeGPTTable(f, table); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// ResizePartition will resize the final partition of a GPT image file, along
+// with the filesystem within it, to size bytes rounded up to a whole MiB. The
+// image file is grown or truncated to fit, moving the backup GPT to the new
+// end of the disk.
+func (m *MountManager) ResizePartition(filename string, partition int, filesystem string, size uint64) error {
+	fs, err := getResizableFilesystem(filesystem)
+	if err != nil {
+		return err
+	}
+	if regular, err := isRegularFile(filename); err != nil || !regular {
+		return fmt.Errorf("Partition resizing requires an image file: %v", filename)
+	}
+	table, err := ReadPartitionTable(filename)
+	if err != nil {
+		return err
+	}
+	if table.Type != PartitionTableGPT {
+		return fmt.Errorf("Partition resizing requires a GPT: %v", filename)
+	}
+	p, err := table.finalPartition(partition)
+	if err != nil {
+		return err
+	}
+
+	size = uint64(Size(size).alignUp(DefaultPartitionAlignment))
+	if size == p.Size {
+		return nil
+	}
+	oldSize := p.Size
+	sector := uint64(table.SectorSize)
+	p.Size = size
+	// Leave room for the backup GPT after the partition
+	table.DiskSize = p.Start + size + (entrySectors(table.SectorSize)+1)*sector
+
+	if size > oldSize {
+		if err := os.Truncate(filename, int64(table.DiskSize)); err != nil {
+			return err
+		}
+		if err := rewriteGPT(filename, table); err != nil {
+			return err
+		}
+		return m.withPartitionLoop(filename, p.Start, size, func(device string) error {
+			return fs.Resize(m, device, 0)
+		})
+	}
+
+	// Shrink the filesystem before the partition
+	err = m.withPartitionLoop(filename, p.Start, oldSize, func(device string) error {
+		return fs.Resize(m, device, size)
+	})
+	if err != nil {
+		return err
+	}
+	if err := rewriteGPT(filename, table); err != nil {
+		return err
+	}
+	return os.Truncate(filename, int64(table.DiskSize))
+}
+
+// ShrinkPartition will shrink the final partition of a GPT image file, and
+// the filesystem within it, to the minimum size of the filesystem plus
+// headroom bytes. The image file is truncated to match, and the new size of
+// the partition is returned.
+func (m *MountManager) ShrinkPartition(filename string, partition int, filesystem string, headroom uint64) (uint64, error) {
+	fs, err := getResizableFilesystem(filesystem)
+	if err != nil {
+		return 0, err
+	}
+	if fs.MinimumSize == nil {
+		return 0, fmt.Errorf("Cannot shrink filesystem '%v'", filesystem)
+	}
+	table, err := ReadPartitionTable(filename)
+	if err != nil {
+		return 0, err
+	}
+	p, err := table.finalPartition(partition)
+	if err != nil {
+		return 0, err
+	}
+	var minimum uint64
+	err = m.withPartitionLoop(filename, p.Start, p.Size, func(device string) error {
+		minimum, err = fs.MinimumSize(m, device)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	size := shrinkTarget(minimum, headroom)
+	if size >= p.Size {
+		return p.Size, nil
+	}
+	if err = m.ResizePartition(filename, partition, filesystem, size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// ResizeFS will resize the filesystem using the global MountManager
+func ResizeFS(filename, filesystem string, size uint64) error {
+	return GetMountManager().ResizeFS(filename, filesystem, size)
+}
+
+// ShrinkFS will shrink the filesystem using the global MountManager
+func ShrinkFS(filename, filesystem string, headroom uint64) (uint64, error) {
+	return GetMountManager().ShrinkFS(filename, filesystem, headroom)
+}
+
+// ResizePartition will resize the partition using the global MountManager
+func ResizePartition(filename string, partition int, filesystem string, size uint64) error {
+	return GetMountManager().ResizePartition(filename, partition, filesystem, size)
+}
+
+// ShrinkPartition will shrink the partition using the global MountManager
+func ShrinkPartition(filename string, partition int, filesystem string, headroom uint64) (uint64, error) {
+	return GetMountManager().ShrinkPartition(filename, partition, filesystem, headroom)
+}
@@ -0,0 +1,155 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Size is a size in bytes
+type Size uint64
+
+const (
+	// Byte is a single byte
+	Byte Size = 1
+
+	// KiB is a kibibyte (1024 bytes)
+	KiB = 1024 * Byte
+
+	// MiB is a mebibyte (1024 KiB)
+	MiB = 1024 * KiB
+
+	// GiB is a gibibyte (1024 MiB)
+	GiB = 1024 * MiB
+
+	// TiB is a tebibyte (1024 GiB)
+	TiB = 1024 * GiB
+
+	// PiB is a pebibyte (1024 TiB)
+	PiB = 1024 * TiB
+
+	// KB is a kilobyte (1000 bytes)
+	KB = 1000 * Byte
+
+	// MB is a megabyte (1000 KB)
+	MB = 1000 * KB
+
+	// GB is a gigabyte (1000 MB)
+	GB = 1000 * MB
+
+	// TB is a terabyte (1000 GB)
+	TB = 1000 * GB
+
+	// PB is a petabyte (1000 TB)
+	PB = 1000 * TB
+)
+
+// sizeUnits maps every accepted unit suffix, in lower case, to its size.
+// Single letters are binary units, as with truncate and qemu-img.
+var sizeUnits = map[string]Size{
+	"":    Byte,
+	"b":   Byte,
+	"k":   KiB,
+	"kib": KiB,
+	"kb":  KB,
+	"m":   MiB,
+	"mib": MiB,
+	"mb":  MB,
+	"g":   GiB,
+	"gib": GiB,
+	"gb":  GB,
+	"t":   TiB,
+	"tib": TiB,
+	"tb":  TB,
+	"p":   PiB,
+	"pib": PiB,
+	"pb":  PB,
+}
+
+// ParseSize will parse a human readable size, such as "4GiB", "512M" or
+// "2.5G". SI units (KB, MB, GB, TB, PB) are powers of 1000, whereas IEC units
+// (KiB, MiB, GiB, TiB, PiB) and the single letter forms (K, M, G, T, P) are
+// powers of 1024. Units are case insensitive, and a plain number is in bytes.
+// Fractional sizes are rounded down to a whole byte. Signs are not accepted.
+func ParseSize(s string) (Size, error) {
+	str := strings.TrimSpace(s)
+	if strings.HasPrefix(str, "-") || strings.HasPrefix(str, "+") {
+		return 0, fmt.Errorf("Invalid size: %v", s)
+	}
+	i := 0
+	for i < len(str) && (str[i] == '.' || (str[i] >= '0' && str[i] <= '9')) {
+		i++
+	}
+	number, suffix := str[:i], strings.TrimSpace(str[i:])
+	unit, ok := sizeUnits[strings.ToLower(suffix)]
+	if !ok {
+		return 0, fmt.Errorf("Unknown size unit '%v' in size: %v", suffix, s)
+	}
+	r, ok := new(big.Rat).SetString(number)
+	if number == "" || !ok {
+		return 0, fmt.Errorf("Invalid size: %v", s)
+	}
+	r.Mul(r, new(big.Rat).SetInt(new(big.Int).SetUint64(uint64(unit))))
+	bytes := new(big.Int).Quo(r.Num(), r.Denom())
+	if !bytes.IsUint64() {
+		return 0, fmt.Errorf("Size is too large: %v", s)
+	}
+	return Size(bytes.Uint64()), nil
+}
+
+// String returns the size in the largest IEC unit it fits, i.e. "4GiB",
+// with two decimal places when the size isn't a whole number of that unit.
+func (s Size) String() string {
+	units := []struct {
+		size Size
+		name string
+	}{
+		{PiB, "PiB"},
+		{TiB, "TiB"},
+		{GiB, "GiB"},
+		{MiB, "MiB"},
+		{KiB, "KiB"},
+	}
+	for _, u := range units {
+		if s < u.size {
+			continue
+		}
+		if s%u.size == 0 {
+			return fmt.Sprintf("%d%s", s/u.size, u.name)
+		}
+		return fmt.Sprintf("%.2f%s", float64(s)/float64(u.size), u.name)
+	}
+	return fmt.Sprintf("%dB", uint64(s))
+}
+
+// alignUp rounds the size up to the next multiple of alignment
+func (s Size) alignUp(alignment Size) Size {
+	if alignment == 0 {
+		return s
+	}
+	return (s + alignment - 1) / alignment * alignment
+}
+
+// alignDown rounds the size down to a multiple of alignment
+func (s Size) alignDown(alignment Size) Size {
+	if alignment == 0 {
+		return s
+	}
+	return s / alignment * alignment
+}
@@ -0,0 +1,91 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	sizes := []struct {
+		input string
+		size  Size
+	}{
+		{"4GiB", 4 * GiB},
+		{"512M", 512 * MiB},
+		{"2.5G", 5 * GiB / 2},
+		{"1.5KB", 1500},
+		{"1.5kb", 1500},
+		{" 8 MiB ", 8 * MiB},
+		{"4096", 4096},
+		{"100b", 100},
+		{"0.1K", 102},
+		{"18446744073709551615", 1<<64 - 1},
+		{"16383PiB", 16383 * PiB},
+	}
+	for _, s := range sizes {
+		size, err := ParseSize(s.input)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", s.input, err)
+			continue
+		}
+		if size != s.size {
+			t.Errorf("Parsed %q as %d, expected %d", s.input, size, s.size)
+		}
+	}
+}
+
+func TestParseSizeInvalid(t *testing.T) {
+	inputs := []string{
+		"",
+		"   ",
+		"-1",
+		"+1",
+		"-1GiB",
+		" -4GiB",
+		"1..2",
+		".",
+		"GiB",
+		"4XiB",
+		"4 G B",
+		"18446744073709551616",
+		"16384PiB",
+	}
+	for _, input := range inputs {
+		if size, err := ParseSize(input); err == nil {
+			t.Errorf("Accepted invalid size %q as %d", input, size)
+		}
+	}
+}
+
+func TestSizeString(t *testing.T) {
+	sizes := []struct {
+		size Size
+		str  string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{4 * GiB, "4GiB"},
+		{1536 * KiB, "1.50MiB"},
+		{1500, "1.46KiB"},
+	}
+	for _, s := range sizes {
+		if str := s.size.String(); str != s.str {
+			t.Errorf("Size %d formatted as %q, expected %q", uint64(s.size), str, s.str)
+		}
+	}
+}
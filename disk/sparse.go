@@ -0,0 +1,171 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+)
+
+// lseek whence values from linux/fs.h, to find the data and holes in a file
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// sparseBufferSize is how much data is read at a time when looking for
+// zero blocks.
+const sparseBufferSize = 1 * MiB
+
+// FileUsage describes how much space a file takes up
+type FileUsage struct {
+	Size      Size // Logical size, as seen by readers of the file
+	Allocated Size // Space allocated on disk, smaller than Size if sparse
+}
+
+// Sparse returns true if the file has holes
+func (f *FileUsage) Sparse() bool {
+	return f.Allocated < f.Size
+}
+
+// GetFileUsage returns the logical and allocated sizes of the file
+func GetFileUsage(filename string) (*FileUsage, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(filename, &st); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: filename, Err: err}
+	}
+	return &FileUsage{
+		Size: Size(st.Size),
+		// st_blocks is always in 512 byte units
+		Allocated: Size(st.Blocks) * 512,
+	}, nil
+}
+
+// isENXIO determines whether the seek failed due to running out of data
+func isENXIO(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == syscall.ENXIO
+	}
+	return false
+}
+
+// nextData returns the start and end of the next extent of data at or after
+// offset, or io.EOF when only holes remain.
+func nextData(f *os.File, offset, size int64) (int64, int64, error) {
+	start, err := f.Seek(offset, seekData)
+	if err != nil {
+		if isENXIO(err) {
+			return 0, 0, io.EOF
+		}
+		// Filesystem can't tell us, so treat the rest as data
+		return offset, size, nil
+	}
+	if start >= size {
+		return 0, 0, io.EOF
+	}
+	end, err := f.Seek(start, seekHole)
+	if err != nil || end > size {
+		end = size
+	}
+	return start, end, nil
+}
+
+// copyExtent will copy length bytes at offset from src to dst
+func (c *copier) copyExtent(src, dst *os.File, offset, length int64) error {
+	if c.options.PunchHoles {
+		return copyNonZero(src, dst, offset, length)
+	}
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := dst.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	var err error
+	if c.options.Reflink {
+		// os.File.ReadFrom uses copy_file_range for a limited *os.File
+		_, err = io.Copy(dst, &io.LimitedReader{R: src, N: length})
+	} else {
+		// Hide ReadFrom/WriteTo to force a plain read and write of the data
+		_, err = io.Copy(struct{ io.Writer }{dst}, &io.LimitedReader{R: struct{ io.Reader }{src}, N: length})
+	}
+	return err
+}
+
+// copyNonZero will copy length bytes at offset from src to dst, skipping
+// over any blocks of zeroes to leave holes in dst.
+func copyNonZero(src, dst *os.File, offset, length int64) error {
+	blockSize := int64(4 * KiB)
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(dst.Fd()), &st); err == nil && st.Blksize > 0 {
+		blockSize = int64(st.Blksize)
+	}
+	buf := make([]byte, sparseBufferSize)
+	zero := make([]byte, blockSize)
+	end := offset + length
+	for offset < end {
+		want := int64(len(buf))
+		if end-offset < want {
+			want = end - offset
+		}
+		n, err := src.ReadAt(buf[:want], offset)
+		if n == 0 && err != nil {
+			return err
+		}
+		for i := int64(0); i < int64(n); i += blockSize {
+			j := i + blockSize
+			if j > int64(n) {
+				j = int64(n)
+			}
+			if bytes.Equal(buf[i:j], zero[:j-i]) {
+				continue
+			}
+			if _, err := dst.WriteAt(buf[i:j], offset+i); err != nil {
+				return err
+			}
+		}
+		offset += int64(n)
+	}
+	return nil
+}
+
+// copySparse will copy only the data extents of src into dst, leaving holes
+// in dst wherever src has them.
+func (c *copier) copySparse(src, dst *os.File) error {
+	st, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	size := st.Size()
+	for offset := int64(0); offset < size; {
+		start, end, err := nextData(src, offset, size)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err = c.copyExtent(src, dst, start, end-start); err != nil {
+			return err
+		}
+		offset = end
+	}
+	// Trailing holes aren't written, so set the size explicitly
+	return dst.Truncate(size)
+}
@@ -0,0 +1,307 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/solus-project/libosdev/commands"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// SquashfsMinBlockSize is the smallest block size supported by squashfs
+	SquashfsMinBlockSize = 4 * KiB
+
+	// SquashfsMaxBlockSize is the largest block size supported by squashfs
+	SquashfsMaxBlockSize = MiB
+)
+
+// SquashfsOptions control how CreateSquashfsWithOptions builds the image
+type SquashfsOptions struct {
+	Compression CompressionType // Compression algorithm, gzip if unset
+
+	// CompressionLevel is 1-9 for gzip and lzo, or 1-22 for zstd. Any level
+	// enables high compression mode for lz4, while xz has no levels. Zero
+	// uses the mksquashfs default.
+	CompressionLevel int
+
+	BlockSize  Size     // Power of two between 4KiB and 1MiB, 128KiB if unset
+	Processors int      // Number of compressor threads, all CPUs if unset
+	Excludes   []string // Wildcard patterns of paths to leave out, relative to the tree
+	SortFile   string   // mksquashfs sort file, to control file placement
+	NoXattrs   bool     // Don't store extended attributes
+	AllRoot    bool     // Make every file owned by root
+
+	// Reproducible sets every timestamp, including that of the filesystem
+	// itself, to SOURCE_DATE_EPOCH (or the epoch itself if unset) and forces
+	// a fixed file ordering regardless of the number of processors.
+	Reproducible bool
+}
+
+// compressionArgs returns the arguments for the compression and its level
+func (s *SquashfsOptions) compressionArgs() ([]string, error) {
+	comp := s.Compression
+	if comp == "" {
+		comp = CompressionGzip
+	}
+	args, err := GetSquashfsArgs(comp)
+	if err != nil {
+		return nil, err
+	}
+	if s.CompressionLevel == 0 {
+		return args, nil
+	}
+
+	max := 0
+	switch comp {
+	case CompressionGzip, CompressionLZO:
+		max = 9
+	case CompressionZstd:
+		max = 22
+	case CompressionLZ4:
+		return append(args, "-Xhc"), nil
+	default:
+		return nil, fmt.Errorf("Compression type %v does not support levels", comp)
+	}
+	if s.CompressionLevel < 1 || s.CompressionLevel > max {
+		return nil, fmt.Errorf("Invalid %v compression level: %d", comp, s.CompressionLevel)
+	}
+	return append(args, "-Xcompression-level", fmt.Sprintf("%d", s.CompressionLevel)), nil
+}
+
+// args returns the mksquashfs arguments for the options
+func (s *SquashfsOptions) args() ([]string, error) {
+	args, err := s.compressionArgs()
+	if err != nil {
+		return nil, err
+	}
+	if s.BlockSize != 0 {
+		if s.BlockSize < SquashfsMinBlockSize || s.BlockSize > SquashfsMaxBlockSize || s.BlockSize&(s.BlockSize-1) != 0 {
+			return nil, fmt.Errorf("Invalid squashfs block size: %d", s.BlockSize)
+		}
+		args = append(args, "-b", fmt.Sprintf("%d", s.BlockSize))
+	}
+	if s.Processors < 0 {
+		return nil, fmt.Errorf("Invalid processor count: %d", s.Processors)
+	}
+	if s.Processors > 0 {
+		args = append(args, "-processors", fmt.Sprintf("%d", s.Processors))
+	}
+	if s.SortFile != "" {
+		sortFile, err := filepath.Abs(s.SortFile)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-sort", sortFile)
+	}
+	if s.NoXattrs {
+		args = append(args, "-no-xattrs")
+	} else {
+		args = append(args, "-xattrs")
+	}
+	if s.AllRoot {
+		args = append(args, "-all-root")
+	}
+	if s.Reproducible {
+		epoch, err := sourceDateEpoch()
+		if err != nil {
+			return nil, err
+		}
+		t := fmt.Sprintf("%d", epoch)
+		args = append(args, "-reproducible", "-mkfs-time", t, "-all-time", t)
+	}
+	// -e takes every remaining argument, so must come last
+	if len(s.Excludes) > 0 {
+		args = append(args, "-wildcards", "-e")
+		args = append(args, s.Excludes...)
+	}
+	return args, nil
+}
+
+// CreateSquashfsWithOptions will create a new squashfs filesystem image at the
+// given outputFile path, containing the tree found at path. options may be nil
+// to use the defaults.
+func CreateSquashfsWithOptions(path, outputFile string, options *SquashfsOptions) error {
+	if options == nil {
+		options = &SquashfsOptions{}
+	}
+	source, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	output, err := filepath.Abs(outputFile)
+	if err != nil {
+		return err
+	}
+	command := []string{
+		source,
+		output,
+	}
+
+	// May have to set -keep-as-directory
+	st, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if st.Mode().IsDir() {
+		command = append(command, "-keep-as-directory")
+	}
+	args, err := options.args()
+	if err != nil {
+		return err
+	}
+	command = append(command, args...)
+	return commands.ExecStdoutArgsDir(filepath.Dir(source), "mksquashfs", command)
+}
+
+// squashfsMagic is "hsqs" in little endian
+const squashfsMagic = 0x73717368
+
+// Superblock flags
+const (
+	squashfsFlagNoFragments = 0x0010
+	squashfsFlagExportable  = 0x0080
+	squashfsFlagNoXattrs    = 0x0200
+)
+
+// squashfsSuperblock is the on disk squashfs 4.0 superblock
+type squashfsSuperblock struct {
+	Magic             uint32
+	InodeCount        uint32
+	ModificationTime  uint32
+	BlockSize         uint32
+	FragmentCount     uint32
+	CompressionID     uint16
+	BlockLog          uint16
+	Flags             uint16
+	IDCount           uint16
+	VersionMajor      uint16
+	VersionMinor      uint16
+	RootInode         uint64
+	BytesUsed         uint64
+	IDTableStart      uint64
+	XattrIDTableStart uint64
+	InodeTableStart   uint64
+	DirTableStart     uint64
+	FragTableStart    uint64
+	ExportTableStart  uint64
+}
+
+// squashfsCompressors maps the superblock compression ID to its name
+var squashfsCompressors = map[uint16]CompressionType{
+	1: CompressionGzip,
+	2: CompressionLZMA,
+	3: CompressionLZO,
+	4: CompressionXZ,
+	5: CompressionLZ4,
+	6: CompressionZstd,
+}
+
+// SquashfsInfo describes a squashfs image, as read from its superblock
+type SquashfsInfo struct {
+	Compression CompressionType // Compression used for the data
+	BlockSize   Size            // Data block size
+	Inodes      uint32          // Number of inodes, i.e. files and directories
+	Fragments   uint32          // Number of fragment blocks
+	BytesUsed   uint64          // Size of the filesystem, excluding padding
+	Created     time.Time       // When the image was created, or -mkfs-time
+	Version     string          // Squashfs format version, i.e. "4.0"
+	NoXattrs    bool            // Whether xattrs were left out
+	Exportable  bool            // Whether the image can be exported over NFS
+	NoFragments bool            // Whether small files were stored without fragments
+}
+
+// ReadSquashfsInfo will read the superblock of the squashfs image
+func ReadSquashfsInfo(filename string) (*SquashfsInfo, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sb := &squashfsSuperblock{}
+	b := make([]byte, binary.Size(sb))
+	if _, err := f.ReadAt(b, 0); err != nil {
+		return nil, fmt.Errorf("Failed to read squashfs superblock: %v", err)
+	}
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, sb); err != nil {
+		return nil, err
+	}
+	if sb.Magic != squashfsMagic {
+		return nil, fmt.Errorf("Not a squashfs image: %v", filename)
+	}
+	if sb.VersionMajor != 4 {
+		return nil, fmt.Errorf("Unsupported squashfs version %d.%d: %v", sb.VersionMajor, sb.VersionMinor, filename)
+	}
+	comp, ok := squashfsCompressors[sb.CompressionID]
+	if !ok {
+		return nil, fmt.Errorf("Unknown squashfs compression ID: %d", sb.CompressionID)
+	}
+	return &SquashfsInfo{
+		Compression: comp,
+		BlockSize:   Size(sb.BlockSize),
+		Inodes:      sb.InodeCount,
+		Fragments:   sb.FragmentCount,
+		BytesUsed:   sb.BytesUsed,
+		Created:     time.Unix(int64(sb.ModificationTime), 0).UTC(),
+		Version:     fmt.Sprintf("%d.%d", sb.VersionMajor, sb.VersionMinor),
+		NoXattrs:    sb.Flags&squashfsFlagNoXattrs != 0,
+		Exportable:  sb.Flags&squashfsFlagExportable != 0,
+		NoFragments: sb.Flags&squashfsFlagNoFragments != 0,
+	}, nil
+}
+
+// squashfsListRoot is the directory unsquashfs prefixes every listed path with
+const squashfsListRoot = "squashfs-root"
+
+// ListSquashfs will list every path within the squashfs image, as absolute
+// paths relative to the root of the image, i.e. "/usr/bin/bash".
+func ListSquashfs(filename string) ([]string, error) {
+	out, err := commands.ExecOutputArgs("unsquashfs", []string{"-l", "-d", squashfsListRoot, filename})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list %v: %v", filename, err)
+	}
+	var ret []string
+	for _, line := range strings.Split(out, "\n") {
+		// Skip any informational output
+		if line == squashfsListRoot {
+			ret = append(ret, "/")
+		} else if strings.HasPrefix(line, squashfsListRoot+"/") {
+			ret = append(ret, line[len(squashfsListRoot):])
+		}
+	}
+	return ret, nil
+}
+
+// ExtractSquashfs will extract the squashfs image into the directory dest,
+// which is created if needed. If any paths are given, only those files and
+// directories within the image are extracted.
+func ExtractSquashfs(filename, dest string, paths ...string) error {
+	if err := os.MkdirAll(dest, 00755); err != nil {
+		return err
+	}
+	args := []string{"-f", "-d", dest, filename}
+	for _, p := range paths {
+		args = append(args, strings.TrimPrefix(p, "/"))
+	}
+	return commands.ExecStdoutArgs("unsquashfs", args)
+}
@@ -0,0 +1,195 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TerminatePolicy decides what happens to processes holding a mount busy
+type TerminatePolicy int
+
+const (
+	// TerminateNever leaves processes alone, and only reports them
+	TerminateNever TerminatePolicy = iota
+
+	// TerminateGraceful sends SIGTERM, followed by SIGKILL should the process
+	// not exit within the TerminateTimeout of the UmountPolicy
+	TerminateGraceful
+
+	// TerminateKill sends SIGKILL immediately
+	TerminateKill
+)
+
+// An UmountPolicy controls how hard UmountWithPolicy tries to cleanly unmount
+// a busy mountpoint, before escalating to forced and lazy unmounts.
+type UmountPolicy struct {
+	MaxTries         int             // Clean unmount attempts, UmountMaxTries if unset
+	RetryTime        time.Duration   // Initial wait between attempts, UmountRetryTime if unset
+	Backoff          float64         // Multiplier applied to the wait after every attempt
+	MaxRetryTime     time.Duration   // Upper bound on the wait, if set
+	Terminate        TerminatePolicy // What to do with processes holding the mount
+	TerminateTimeout time.Duration   // How long to wait between SIGTERM and SIGKILL, ProcessKillTimeout if unset
+	DisableForce     bool            // Never attempt a forced unmount
+	DisableLazy      bool            // Never resort to a lazy detach
+}
+
+// DefaultUmountPolicy retries a few times at a fixed interval, never touches
+// any processes, and escalates to forced and then lazy unmounts.
+var DefaultUmountPolicy = UmountPolicy{
+	MaxTries:  UmountMaxTries,
+	RetryTime: UmountRetryTime,
+	Backoff:   1,
+	Terminate: TerminateNever,
+}
+
+// withDefaults returns a copy of the policy with unset fields filled in
+func (p *UmountPolicy) withDefaults() UmountPolicy {
+	if p == nil {
+		return DefaultUmountPolicy
+	}
+	ret := *p
+	if ret.MaxTries <= 0 {
+		ret.MaxTries = UmountMaxTries
+	}
+	if ret.RetryTime <= 0 {
+		ret.RetryTime = UmountRetryTime
+	}
+	if ret.Backoff < 1 {
+		ret.Backoff = 1
+	}
+	if ret.TerminateTimeout <= 0 {
+		ret.TerminateTimeout = ProcessKillTimeout
+	}
+	return ret
+}
+
+// nextWait applies the backoff to the current wait time
+func (p *UmountPolicy) nextWait(wait time.Duration) time.Duration {
+	wait = time.Duration(float64(wait) * p.Backoff)
+	if p.MaxRetryTime > 0 && wait > p.MaxRetryTime {
+		wait = p.MaxRetryTime
+	}
+	return wait
+}
+
+// An UmountError describes a mountpoint that could not be cleanly unmounted,
+// and what was attempted along the way.
+type UmountError struct {
+	MountPoint string     // The mountpoint that failed to unmount
+	Err        error      // The error from the last clean unmount attempt
+	Forced     bool       // Whether a forced unmount was attempted
+	Lazy       bool       // Whether a lazy detach was attempted
+	Detached   bool       // Whether the lazy detach succeeded, leaking the busy mount
+	Unmounted  bool       // Whether the mount is gone, whether forced or detached
+	Holders    []*Process // Processes that were keeping the mountpoint busy
+	Terminated []*Process // Processes that were terminated according to policy
+	Tries      int        // Number of clean unmount attempts made
+}
+
+// Error returns a description of the failure and the processes responsible
+func (e *UmountError) Error() string {
+	msg := fmt.Sprintf("Failed to umount %v: %v", e.MountPoint, e.Err)
+	var notes []string
+	if e.Forced {
+		if e.Unmounted && !e.Lazy {
+			notes = append(notes, "forced")
+		} else {
+			notes = append(notes, "forced unmount failed")
+		}
+	}
+	if e.Detached {
+		notes = append(notes, "lazily detached")
+	} else if e.Lazy {
+		notes = append(notes, "lazy detach failed")
+	}
+	if len(e.Holders) > 0 {
+		notes = append(notes, "held by "+joinProcesses(e.Holders))
+	}
+	if len(e.Terminated) > 0 {
+		notes = append(notes, "terminated "+joinProcesses(e.Terminated))
+	}
+	if len(notes) > 0 {
+		msg += " (" + strings.Join(notes, "; ") + ")"
+	}
+	return msg
+}
+
+// appendProcesses will append the processes not already in procs, by PID
+func appendProcesses(procs, more []*Process) []*Process {
+	for _, p := range more {
+		seen := false
+		for _, q := range procs {
+			if q.PID == p.PID {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			procs = append(procs, p)
+		}
+	}
+	return procs
+}
+
+// joinProcesses returns a comma separated description of the processes
+func joinProcesses(procs []*Process) string {
+	var ret []string
+	for _, p := range procs {
+		ret = append(ret, p.String())
+	}
+	return strings.Join(ret, ", ")
+}
+
+// UmountErrors is returned when tearing down multiple mountpoints, listing
+// every failure that occurred. The errors are usually of type *UmountError.
+type UmountErrors []error
+
+// Error returns a summary of all of the failures
+func (e UmountErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, "    "+err.Error())
+	}
+	return fmt.Sprintf("Failed to umount %d mountpoints:\n%s", len(e), strings.Join(msgs, "\n"))
+}
+
+// add will record the error if set, flattening any nested UmountErrors
+func (e *UmountErrors) add(err error) {
+	if err == nil {
+		return
+	}
+	if errs, ok := err.(UmountErrors); ok {
+		*e = append(*e, errs...)
+		return
+	}
+	*e = append(*e, err)
+}
+
+// errorOrNil returns nil when there are no errors, to avoid returning a nil
+// UmountErrors inside a non-nil error interface.
+func (e UmountErrors) errorOrNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
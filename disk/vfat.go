@@ -0,0 +1,136 @@
+//
+// Copyright © 2016 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package disk
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// VfatOptions control the geometry of a FAT filesystem
+type VfatOptions struct {
+	FatSize     int // 12, 16 or 32 bit FAT, 32 if unset
+	SectorSize  int // Logical sector size in bytes, 512 if unset
+	ClusterSize int // Cluster size in bytes, chosen by mkfs.fat if unset
+}
+
+// args returns the mkfs.fat arguments for the options
+func (v *VfatOptions) args() ([]string, error) {
+	sector := v.SectorSize
+	if sector == 0 {
+		sector = 512
+	}
+	if sector < 512 || sector > 4096 || sector&(sector-1) != 0 {
+		return nil, fmt.Errorf("Invalid FAT sector size: %v", sector)
+	}
+	fatSize := v.FatSize
+	if fatSize == 0 {
+		fatSize = 32
+	}
+	if fatSize != 12 && fatSize != 16 && fatSize != 32 {
+		return nil, fmt.Errorf("Invalid FAT size: %v", fatSize)
+	}
+	args := []string{"-F", fmt.Sprintf("%d", fatSize), "-S", fmt.Sprintf("%d", sector)}
+	if v.ClusterSize == 0 {
+		return args, nil
+	}
+	if v.ClusterSize%sector != 0 {
+		return nil, fmt.Errorf("FAT cluster size %v is not a multiple of the sector size", v.ClusterSize)
+	}
+	perCluster := v.ClusterSize / sector
+	if perCluster > 128 || perCluster&(perCluster-1) != 0 {
+		return nil, fmt.Errorf("Invalid FAT cluster size: %v", v.ClusterSize)
+	}
+	return append(args, "-s", fmt.Sprintf("%d", perCluster)), nil
+}
+
+// vfatVolumeID returns the 32-bit volume ID for mkfs.fat from either a FAT
+// style "ABCD-1234" ID, or the first 8 hex digits of a full UUID.
+func vfatVolumeID(uuid string) (string, error) {
+	id := strings.Replace(uuid, "-", "", -1)
+	if len(id) < 8 {
+		return "", fmt.Errorf("Invalid FAT volume ID: %v", uuid)
+	}
+	if _, err := hex.DecodeString(id[:8]); err != nil {
+		return "", fmt.Errorf("Invalid FAT volume ID: %v", uuid)
+	}
+	return id[:8], nil
+}
+
+// FormatVfat will format the path as FAT, by default FAT32 as required for
+// an EFI System Partition. options may be nil to use the default geometry.
+//
+// Note that FAT32 requires at least 65525 clusters, so small filesystems
+// will need a smaller ClusterSize, or a smaller FatSize.
+func FormatVfat(filename string, options *VfatOptions) error {
+	return FormatAs(filename, "vfat", &FormatOptions{Vfat: options})
+}
+
+func formatVfat(filename string, options *FormatOptions) error {
+	if err := options.check("vfat", formatOptLabel|formatOptUUID|formatOptVfat|formatOptReproducible); err != nil {
+		return err
+	}
+	vfat := options.Vfat
+	if vfat == nil {
+		vfat = &VfatOptions{}
+	}
+	geometry, err := vfat.args()
+	if err != nil {
+		return err
+	}
+	// Partitions attached as their own loop device look like a whole disk,
+	// which mkfs.fat will otherwise refuse to format.
+	args := []string{"-I"}
+	args = append(args, geometry...)
+	if options.Label != "" {
+		args = append(args, "-n", options.Label)
+	}
+	// --invariant resets the volume ID, so it must come before -i
+	if options.Reproducible {
+		args = append(args, "--invariant")
+	}
+	if options.UUID != "" {
+		id, err := vfatVolumeID(options.UUID)
+		if err != nil {
+			return err
+		}
+		args = append(args, "-i", id)
+	}
+	return runFormat(options, "mkfs.fat", append(args, filename))
+}
+
+func checkVfat(filename string, mode CheckMode) (*CheckResult, error) {
+	args := []string{"-a", "-w", filename}
+	if mode == CheckReadOnly {
+		args = []string{"-n", filename}
+	}
+	// fsck.fat doesn't use the fsck bitmask: 1 means errors were found,
+	// which have been fixed unless we're read-only, and 2 is a usage error.
+	return runCheck(func(code int) CheckStatus {
+		switch {
+		case code == 0:
+			return CheckClean
+		case code == 1 && mode == CheckRepair:
+			return CheckCorrected
+		case code == 1:
+			return CheckUncorrected
+		default:
+			return CheckOperationalError
+		}
+	}, "fsck.fat", args)
+}
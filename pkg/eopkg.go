@@ -46,11 +46,24 @@ type EopkgManager struct {
 	dbusActive bool // Whether we have dbus alive or not
 
 	cacheSource string // Where we find the cache directory
+
+	mounts *disk.MountManager // Tracks our mounts
 }
 
-// NewEopkgManager will return a newly initialised EopkgManager
+// NewEopkgManager will return a newly initialised EopkgManager, using the
+// global MountManager
 func NewEopkgManager() *EopkgManager {
-	return &EopkgManager{targetMode: false, cacheSource: EopkgCacheDirectory}
+	return &EopkgManager{
+		targetMode:  false,
+		cacheSource: EopkgCacheDirectory,
+		mounts:      disk.GetMountManager(),
+	}
+}
+
+// SetMountManager will override the MountManager used for all mounts, so
+// that they can be scoped to an individual build.
+func (e *EopkgManager) SetMountManager(m *disk.MountManager) {
+	e.mounts = m
 }
 
 // SetCacheDirectory is used to override the system cache directory
@@ -72,6 +85,12 @@ func (e *EopkgManager) InitRoot(root string) error {
 	e.root = root
 	e.targetMode = true
 
+	// Anything left running in the root is killed should the build be
+	// interrupted
+	if err := e.mounts.AddRoot(root); err != nil {
+		return err
+	}
+
 	// Ensures we don't end up with /var/lock vs /run/lock nonsense
 	reqDirs := []string{
 		"run/lock",
@@ -101,8 +120,11 @@ func (e *EopkgManager) InitRoot(root string) error {
 	}
 
 	// Now attempt to bind mount the cache directory to be .. well. usable
+	// It's a slave so that host side mounts within the cache still show up,
+	// without our own mounts leaking back out to the host.
 	e.cacheTarget = filepath.Join(root, "var", "cache", "eopkg", "packages")
-	if err := disk.GetMountManager().BindMount(e.cacheSource, e.cacheTarget); err != nil {
+	cacheOptions := &disk.MountOptions{Propagation: disk.PropagationRSlave}
+	if err := e.mounts.BindMountWithOptions(e.cacheSource, e.cacheTarget, cacheOptions); err != nil {
 		return err
 	}
 
@@ -113,7 +135,7 @@ func (e *EopkgManager) InitRoot(root string) error {
 // ensure that dbus, etc, works.
 func (e *EopkgManager) FinalizeRoot() error {
 	// First things first, unmount the cache
-	if err := disk.GetMountManager().Unmount(e.cacheTarget); err != nil {
+	if err := e.mounts.Unmount(e.cacheTarget); err != nil {
 		return err
 	}
 	// Copy base layout